@@ -0,0 +1,215 @@
+package mediaserver
+
+import (
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// CacheLimits describes how large the processed cache may grow before files are evicted.
+// Zero values are unlimited.
+type CacheLimits struct {
+	MaxBytes int64         // Least recently used files are evicted until the cache is smaller than this
+	MaxAge   time.Duration // Files that have not been used for this long are evicted
+}
+
+// GCResult reports the outcome of a garbage collection run
+type GCResult struct {
+	Files        int   // Number of processed files remaining in the cache
+	Bytes        int64 // Number of bytes remaining in the cache
+	Removed      int   // Number of processed files removed
+	RemovedBytes int64 // Number of bytes removed
+}
+
+// cacheEntry tracks a single processed file
+type cacheEntry struct {
+	size       int64
+	lastAccess time.Time
+}
+
+// cacheManager tracks the size and last access time of every file in the processed cache.
+// It only ever manages the processed filesystem, and never removes original files.
+// Tracking happens in memory, so each process only knows about the accesses that it has seen.
+type cacheManager struct {
+	limits  CacheLimits
+	entries map[string]cacheEntry
+	bytes   int64
+	loaded  bool
+	mutex   sync.Mutex
+}
+
+func newCacheManager() *cacheManager {
+	return &cacheManager{
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// record adds (or updates) a processed file in the cache
+func (manager *cacheManager) record(path string, size int64) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if existing, ok := manager.entries[path]; ok {
+		manager.bytes -= existing.size
+	}
+
+	manager.entries[path] = cacheEntry{size: size, lastAccess: time.Now()}
+	manager.bytes += size
+}
+
+// touch updates the last access time of a processed file
+func (manager *cacheManager) touch(path string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if entry, ok := manager.entries[path]; ok {
+		entry.lastAccess = time.Now()
+		manager.entries[path] = entry
+	}
+}
+
+// forget removes a processed file from the cache, without touching the filesystem
+func (manager *cacheManager) forget(path string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.forgetLocked(path)
+}
+
+// forgetPrefix removes every processed file within a directory from the cache, without touching the filesystem
+func (manager *cacheManager) forgetPrefix(directory string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for path := range manager.entries {
+		if strings.HasPrefix(path, directory+"/") {
+			manager.forgetLocked(path)
+		}
+	}
+}
+
+func (manager *cacheManager) forgetLocked(path string) {
+
+	if existing, ok := manager.entries[path]; ok {
+		manager.bytes -= existing.size
+		delete(manager.entries, path)
+	}
+}
+
+// load seeds the cache by walking the processed filesystem.  Files that have not
+// been seen yet use their modification time as their last access time.
+func (manager *cacheManager) load(processed afero.Fs) error {
+
+	manager.mutex.Lock()
+	loaded := manager.loaded
+	manager.mutex.Unlock()
+
+	if loaded {
+		return nil
+	}
+
+	// Walk without holding the lock, so that requests are not blocked behind a full scan
+	found := make(map[string]cacheEntry)
+
+	err := afero.Walk(processed, "", func(path string, info fs.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden directories (such as staging areas for uploads and processed files), which are not part of the cache
+		if info.IsDir() {
+			if (path != "") && strings.HasPrefix(info.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		found[strings.TrimPrefix(path, "/")] = cacheEntry{size: info.Size(), lastAccess: info.ModTime()}
+		return nil
+	})
+
+	if err != nil {
+		return derp.Wrap(err, "mediaserver.cacheManager.load", "Unable to walk processed filesystem")
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.loaded {
+		return nil
+	}
+
+	// Files recorded during the walk are more up to date than the walk itself
+	for path, entry := range found {
+		if _, ok := manager.entries[path]; !ok {
+			manager.entries[path] = entry
+			manager.bytes += entry.size
+		}
+	}
+
+	manager.loaded = true
+	return nil
+}
+
+// candidates returns the processed files that should be evicted to satisfy the cache limits,
+// oldest first.
+func (manager *cacheManager) candidates(now time.Time) []string {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	type candidate struct {
+		path  string
+		entry cacheEntry
+	}
+
+	// Sort all entries by last access time (least recent first)
+	all := make([]candidate, 0, len(manager.entries))
+
+	for path, entry := range manager.entries {
+		all = append(all, candidate{path: path, entry: entry})
+	}
+
+	slices.SortFunc(all, func(a candidate, b candidate) int {
+		return a.entry.lastAccess.Compare(b.entry.lastAccess)
+	})
+
+	result := make([]string, 0)
+	remaining := manager.bytes
+
+	for _, item := range all {
+
+		expired := (manager.limits.MaxAge > 0) && (now.Sub(item.entry.lastAccess) > manager.limits.MaxAge)
+		overBudget := (manager.limits.MaxBytes > 0) && (remaining > manager.limits.MaxBytes)
+
+		if !expired && !overBudget {
+			break
+		}
+
+		result = append(result, item.path)
+		remaining -= item.entry.size
+	}
+
+	return result
+}
+
+// stats returns the number of files and bytes currently tracked
+func (manager *cacheManager) stats() (int, int64) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return len(manager.entries), manager.bytes
+}
+
+// size returns the tracked size of a processed file
+func (manager *cacheManager) size(path string) int64 {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return manager.entries[path].size
+}
@@ -0,0 +1,144 @@
+package mediaserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/benpate/derp"
+)
+
+// ClamdScanner is a Scanner that streams uploads to a clamd server, using its INSTREAM command.
+// Uploads larger than clamd's StreamMaxLength cannot be scanned, so they are rejected.
+type ClamdScanner struct {
+	Network   string        // Network of the clamd server, such as "tcp" or "unix"
+	Address   string        // Address of the clamd server, such as "localhost:3310" or "/run/clamav/clamd.ctl"
+	Timeout   time.Duration // Longest time to spend on a single scan
+	ChunkSize int           // Number of bytes sent to clamd at a time
+}
+
+// NewClamdScanner returns a fully initialized ClamdScanner
+func NewClamdScanner(network string, address string) ClamdScanner {
+	return ClamdScanner{
+		Network:   network,
+		Address:   address,
+		Timeout:   time.Minute,
+		ChunkSize: 64 * 1024,
+	}
+}
+
+// Scan implements the Scanner interface
+func (scanner ClamdScanner) Scan(file io.Reader) (ScanResult, error) {
+
+	const location = "mediaserver.ClamdScanner.Scan"
+
+	connection, err := net.DialTimeout(scanner.Network, scanner.Address, scanner.Timeout)
+
+	if err != nil {
+		return ScanResult{}, derp.Wrap(err, location, "Unable to connect to clamd", scanner.Address)
+	}
+
+	defer func() {
+		if err := connection.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close connection to clamd", scanner.Address))
+		}
+	}()
+
+	if scanner.Timeout > 0 {
+		if err := connection.SetDeadline(time.Now().Add(scanner.Timeout)); err != nil {
+			return ScanResult{}, derp.Wrap(err, location, "Unable to set deadline", scanner.Address)
+		}
+	}
+
+	// Stream the file as length-prefixed chunks, followed by a zero-length chunk
+	if err := scanner.stream(connection, file); err != nil {
+
+		// clamd stops reading when the stream is too large, so report its reason (if it sent one)
+		if response, readErr := readClamdResponse(connection); readErr == nil {
+			return ScanResult{}, derp.Wrap(err, location, "Unable to send file to clamd", response)
+		}
+
+		return ScanResult{}, derp.Wrap(err, location, "Unable to send file to clamd")
+	}
+
+	response, err := readClamdResponse(connection)
+
+	if err != nil {
+		return ScanResult{}, derp.Wrap(err, location, "Unable to read response from clamd")
+	}
+
+	return parseClamdResponse(response)
+}
+
+// stream sends the INSTREAM command and the contents of the file to clamd
+func (scanner ClamdScanner) stream(connection net.Conn, file io.Reader) error {
+
+	if _, err := connection.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+
+	chunkSize := scanner.ChunkSize
+
+	if chunkSize <= 0 {
+		chunkSize = 64 * 1024
+	}
+
+	buffer := make([]byte, 4+chunkSize)
+
+	for {
+		length, err := io.ReadFull(file, buffer[4:])
+
+		if length > 0 {
+			binary.BigEndian.PutUint32(buffer, uint32(length))
+
+			if _, err := connection.Write(buffer[:4+length]); err != nil {
+				return err
+			}
+		}
+
+		if (err == io.EOF) || (err == io.ErrUnexpectedEOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := connection.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// readClamdResponse reads a single (null-terminated) response from clamd
+func readClamdResponse(connection net.Conn) (string, error) {
+
+	response, err := bufio.NewReader(io.LimitReader(connection, 4096)).ReadString(0)
+
+	if (err != nil) && ((err != io.EOF) || (response == "")) {
+		return "", err
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(response, "\x00")), nil
+}
+
+// parseClamdResponse converts a clamd response (such as "stream: OK"
+// or "stream: Eicar-Signature FOUND") into a ScanResult
+func parseClamdResponse(response string) (ScanResult, error) {
+
+	const location = "mediaserver.parseClamdResponse"
+
+	verdict := strings.TrimPrefix(response, "stream: ")
+
+	if verdict == "OK" {
+		return ScanResult{}, nil
+	}
+
+	if signature, ok := strings.CutSuffix(verdict, " FOUND"); ok {
+		return ScanResult{Infected: true, Signature: signature}, nil
+	}
+
+	return ScanResult{}, derp.InternalError(location, "Unable to scan file", response)
+}
@@ -0,0 +1,159 @@
+package mediaserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd starts a TCP server that speaks enough of the clamd INSTREAM protocol
+// to report files containing "EICAR" as infected.  It returns the server's address.
+func fakeClamd(t *testing.T) string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			connection, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer connection.Close()
+
+				reader := bufio.NewReader(connection)
+
+				if command, err := reader.ReadString(0); (err != nil) || (command != "zINSTREAM\x00") {
+					_, _ = connection.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var content bytes.Buffer
+				header := make([]byte, 4)
+
+				for {
+					if _, err := io.ReadFull(reader, header); err != nil {
+						return
+					}
+
+					length := binary.BigEndian.Uint32(header)
+
+					if length == 0 {
+						break
+					}
+
+					if _, err := io.CopyN(&content, reader, int64(length)); err != nil {
+						return
+					}
+				}
+
+				if strings.Contains(content.String(), "EICAR") {
+					_, _ = connection.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					_, _ = connection.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+
+	scanner := NewClamdScanner("tcp", fakeClamd(t))
+	scanner.ChunkSize = 4
+
+	result, err := scanner.Scan(strings.NewReader("hello world"))
+	require.Nil(t, err)
+	require.False(t, result.Infected)
+
+	result, err = scanner.Scan(strings.NewReader("hello EICAR world"))
+	require.Nil(t, err)
+	require.True(t, result.Infected)
+	require.Equal(t, "Eicar-Test-Signature", result.Signature)
+
+	_, err = parseClamdResponse("INSTREAM size limit exceeded. ERROR")
+	require.NotNil(t, err)
+}
+
+func TestUpload_Scanner(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	quarantine := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working, WithScanner(NewClamdScanner("tcp", fakeClamd(t))), WithQuarantine(quarantine))
+
+	// Clean uploads are stored
+	_, err := ms.Upload("clean", strings.NewReader("hello world"))
+	require.Nil(t, err)
+
+	exists, err := afero.Exists(original, "clean")
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	// Infected uploads are quarantined instead of stored
+	_, err = ms.Upload("folder/infected", strings.NewReader("hello EICAR world"))
+	require.Equal(t, http.StatusUnprocessableEntity, derp.ErrorCode(err))
+
+	infected, ok := derp.RootCause(err).(InfectedError)
+	require.True(t, ok)
+	require.Equal(t, "Eicar-Test-Signature", infected.Signature)
+
+	exists, err = afero.Exists(original, "folder/infected")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	content, err := afero.ReadFile(quarantine, "folder/infected")
+	require.Nil(t, err)
+	require.Equal(t, "hello EICAR world", string(content))
+
+	// Infected replacements leave the clean original untouched
+	_, err = ms.Upload("clean", strings.NewReader("goodbye EICAR world"))
+	require.IsType(t, InfectedError{}, derp.RootCause(err))
+
+	content, err = afero.ReadFile(original, "clean")
+	require.Nil(t, err)
+	require.Equal(t, "hello world", string(content))
+
+	// Normalized uploads are scanned as they were received, before they are normalized or archived
+	archive := afero.NewMemMapFs()
+	ms = New(original, afero.NewMemMapFs(), &working, WithScanner(NewClamdScanner("tcp", fakeClamd(t))), WithQuarantine(quarantine), WithNormalization(Normalization{MaxWidth: 100, Archive: archive}))
+
+	_, err = ms.Upload("normalized", strings.NewReader("hello EICAR"))
+	require.IsType(t, InfectedError{}, derp.RootCause(err))
+
+	content, err = afero.ReadFile(quarantine, "normalized")
+	require.Nil(t, err)
+	require.Equal(t, "hello EICAR", string(content))
+
+	exists, err = afero.Exists(archive, "normalized")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// Uploads that cannot be scanned are rejected
+	ms = New(original, afero.NewMemMapFs(), &working, WithScanner(NewClamdScanner("tcp", "127.0.0.1:1")))
+
+	_, err = ms.Upload("unscanned", strings.NewReader("hello world"))
+	require.NotNil(t, err)
+
+	exists, err = afero.Exists(original, "unscanned")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/mediaserver"
+	"github.com/spf13/afero"
+)
+
+// application bundles together the MediaServer and its filesystems for each command
+type application struct {
+	server    mediaserver.MediaServer
+	original  afero.Fs
+	processed afero.Fs
+	working   *mediaserver.WorkingDirectory
+}
+
+// put uploads a file into the original filesystem
+func (app application) put(args []string) error {
+
+	const location = "main.application.put"
+
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 {
+		return errors.New("usage: mediaserver put <filename> [source]")
+	}
+
+	var source io.Reader = os.Stdin
+
+	if flags.NArg() > 1 {
+
+		file, err := os.Open(flags.Arg(1))
+
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if err := file.Close(); err != nil {
+				derp.Report(derp.Wrap(err, location, "Unable to close source file", flags.Arg(1)))
+			}
+		}()
+
+		source = file
+	}
+
+	return app.server.Put(flags.Arg(0), source)
+}
+
+// get writes a processed variant of a file to a local file (or stdout)
+func (app application) get(args []string) error {
+
+	const location = "main.application.get"
+
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	width := flags.Int("w", 0, "requested width (images and video)")
+	height := flags.Int("h", 0, "requested height (images and video)")
+	bitrate := flags.Int("b", 0, "requested bitrate in kbps (audio)")
+	extension := flags.String("ext", "", "requested output extension, such as .webp (defaults to the original type)")
+	output := flags.String("o", "", "output file (defaults to stdout)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: mediaserver get [-w width] [-h height] [-b bitrate] [-ext extension] [-o output] <filename>")
+	}
+
+	filespec, err := app.fileSpec(flags.Arg(0))
+
+	if err != nil {
+		return err
+	}
+
+	filespec.Width = *width
+	filespec.Height = *height
+	filespec.Bitrate = *bitrate
+
+	if *extension != "" {
+		filespec.Extension = "." + strings.TrimPrefix(*extension, ".")
+	}
+
+	var writer io.Writer = os.Stdout
+
+	if *output != "" {
+
+		file, err := os.Create(*output)
+
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if err := file.Close(); err != nil {
+				derp.Report(derp.Wrap(err, location, "Unable to close output file", *output))
+			}
+		}()
+
+		writer = file
+	}
+
+	return app.server.Process(filespec, writer)
+}
+
+// probe prints ffprobe information about an original file
+func (app application) probe(args []string) error {
+
+	if len(args) != 1 {
+		return errors.New("usage: mediaserver probe <filename>")
+	}
+
+	result, err := app.server.Probe(args[0])
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// delete removes original files and all of their variants
+func (app application) delete(args []string) error {
+
+	if len(args) == 0 {
+		return errors.New("usage: mediaserver delete <filename>...")
+	}
+
+	for _, filename := range args {
+		if err := app.server.Delete(filename); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// list prints the name and size of every original file that matches the (optional) prefix
+func (app application) list(args []string) error {
+
+	prefix := ""
+
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+
+	cursor := ""
+
+	for {
+		originals, next, err := app.server.List(prefix, cursor, 0)
+
+		if err != nil {
+			return err
+		}
+
+		for _, original := range originals {
+			fmt.Printf("%s\t%d\n", original.Filename, original.Size)
+		}
+
+		if next == "" {
+			return nil
+		}
+
+		cursor = next
+	}
+}
+
+// variants lists the processed variants that exist for an original file
+func (app application) variants(args []string) error {
+
+	if len(args) != 1 {
+		return errors.New("usage: mediaserver variants <filename>")
+	}
+
+	variants, err := app.server.Variants(args[0])
+
+	if err != nil {
+		return err
+	}
+
+	for _, variant := range variants {
+
+		status := "current"
+
+		if variant.Stale {
+			status = "stale"
+		}
+
+		fmt.Printf("%s\t%d\t%s\t%s\n", variant.FileSpec.URL(), variant.Size, variant.ModTime.Format(time.RFC3339), status)
+	}
+
+	return nil
+}
+
+// warm generates processed variants for original files, skipping variants that already exist
+func (app application) warm(args []string) error {
+
+	flags := flag.NewFlagSet("warm", flag.ContinueOnError)
+	variants := variantFlags{}
+	flags.Var(&variants, "variant", "variant to generate, such as \"webp?w=300&h=300\" (may be repeated)")
+	resume := flags.String("resume", "", "checkpoint (from an earlier, interrupted run) to resume after")
+	concurrency := flags.Int("concurrency", 1, "number of files to warm at the same time")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(variants) == 0 {
+		return errors.New("usage: mediaserver warm -variant <ext?w=&h=&b=> [-variant ...] [-resume checkpoint] [-concurrency n] [filename...]")
+	}
+
+	// If no filenames are provided, then warm every original file
+	var filenames iter.Seq[string]
+
+	if flags.NArg() > 0 {
+		filenames = slices.Values(flags.Args())
+	}
+
+	// Stop gracefully on Ctrl-C so that the checkpoint can be reported
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	progress, err := app.server.Warm(ctx, filenames, variants,
+		mediaserver.WithWarmResume(*resume),
+		mediaserver.WithWarmConcurrency(*concurrency),
+		mediaserver.WithWarmProgress(func(progress mediaserver.WarmProgress) {
+			fmt.Fprintf(os.Stderr, "%s\tfiles=%d generated=%d skipped=%d failed=%d checkpoint=%s\n",
+				progress.Filename, progress.Files, progress.Generated, progress.Skipped, progress.Failed, progress.Checkpoint)
+		}),
+	)
+
+	fmt.Printf("files=%d generated=%d skipped=%d failed=%d checkpoint=%s\n",
+		progress.Files, progress.Generated, progress.Skipped, progress.Failed, progress.Checkpoint)
+
+	if err != nil {
+		return err
+	}
+
+	if progress.Failed > 0 {
+		return fmt.Errorf("%d variants could not be generated", progress.Failed)
+	}
+
+	return nil
+}
+
+// gc removes processed files whose original file no longer exists or that were created
+// by an older processing pipeline, then (optionally) evicts processed files to satisfy size and age limits
+func (app application) gc(args []string) error {
+
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	maxBytes := flags.Int64("max-bytes", 0, "evict least recently used files until the processed cache is smaller than this")
+	maxAge := flags.Duration("max-age", 0, "evict processed files that have not been used for this long")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: mediaserver gc [-max-bytes bytes] [-max-age duration]")
+	}
+
+	// Remove orphaned processed files
+	err := walkFiles(app.processed, func(filename string, _ fs.FileInfo) error {
+
+		original := path.Dir(filename)
+
+		if exists, err := afero.Exists(app.original, original); err != nil {
+			return err
+		} else if exists {
+			return nil
+		}
+
+		fmt.Println("removing", filename)
+		return app.processed.Remove(filename)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Remove processed files created by an older processing pipeline
+	stale, err := app.server.PurgeStaleVariants()
+
+	if err != nil {
+		return err
+	}
+
+	if stale > 0 {
+		fmt.Printf("removed %d stale processed files\n", stale)
+	}
+
+	// Evict processed files that exceed the cache limits
+	if (*maxBytes == 0) && (*maxAge == 0) {
+		return nil
+	}
+
+	limits := mediaserver.CacheLimits{MaxBytes: *maxBytes, MaxAge: *maxAge}
+	server := mediaserver.New(app.original, app.processed, app.working, mediaserver.WithCacheLimits(limits))
+
+	result, err := server.GC()
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("removed=%d removedBytes=%d files=%d bytes=%d\n", result.Removed, result.RemovedBytes, result.Files, result.Bytes)
+	return nil
+}
+
+// verify checks that every original file is readable, and that every processed file has an original
+func (app application) verify(args []string) error {
+
+	const location = "main.application.verify"
+
+	if len(args) != 0 {
+		return errors.New("usage: mediaserver verify")
+	}
+
+	problems := 0
+
+	report := func(filename string, problem string) {
+		fmt.Printf("%s\t%s\n", filename, problem)
+		problems++
+	}
+
+	// Every original file must be completely readable
+	err := walkFiles(app.original, func(filename string, info fs.FileInfo) error {
+
+		file, err := app.original.Open(filename)
+
+		if err != nil {
+			report(filename, "unable to open original: "+err.Error())
+			return nil
+		}
+
+		defer func() {
+			if err := file.Close(); err != nil {
+				derp.Report(derp.Wrap(err, location, "Unable to close original file", filename))
+			}
+		}()
+
+		if length, err := io.Copy(io.Discard, file); err != nil {
+			report(filename, "unable to read original: "+err.Error())
+		} else if length != info.Size() {
+			report(filename, fmt.Sprintf("original is truncated: read %d of %d bytes", length, info.Size()))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Every processed file must be non-empty, and must have an original
+	err = walkFiles(app.processed, func(filename string, info fs.FileInfo) error {
+
+		if info.Size() == 0 {
+			report(filename, "processed file is empty")
+		}
+
+		if exists, err := afero.Exists(app.original, path.Dir(filename)); err != nil {
+			return err
+		} else if !exists {
+			report(filename, "processed file has no original")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+
+	fmt.Println("ok")
+	return nil
+}
+
+// fileSpec returns a FileSpec for an original file, with its original type detected from the file contents.
+// The requested extension defaults to the original extension.
+func (app application) fileSpec(filename string) (mediaserver.FileSpec, error) {
+
+	result := mediaserver.NewFileSpec()
+	result.Filename = filename
+
+	extension, err := app.server.DetectExtension(filename)
+
+	if err != nil {
+		return result, err
+	}
+
+	result.OriginalExtension = extension
+	result.Extension = extension
+	return result, nil
+}
+
+// walkFiles calls fn for every (non-directory) file in the filesystem.
+// Hidden directories (such as staging areas for resumable uploads) are skipped.
+func walkFiles(filesystem afero.Fs, fn func(filename string, info fs.FileInfo) error) error {
+
+	return afero.Walk(filesystem, "", func(filename string, info fs.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if (filename != "") && strings.HasPrefix(info.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		return fn(strings.TrimPrefix(filename, "/"), info)
+	})
+}
+
+// variantFlags collects repeated -variant flags into a list of FileSpecs
+type variantFlags []mediaserver.FileSpec
+
+func (v *variantFlags) String() string {
+	return fmt.Sprint(len(*v), " variants")
+}
+
+func (v *variantFlags) Set(value string) error {
+
+	parsed, err := url.Parse(value)
+
+	if err != nil {
+		return err
+	}
+
+	filespec := mediaserver.ParseFileSpec("."+strings.TrimPrefix(parsed.Path, "."), parsed.Query())
+	*v = append(*v, filespec)
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/mediaserver"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_Arguments(t *testing.T) {
+
+	working := t.TempDir()
+	global := []string{"-original", "memory", "-processed", "memory", "-working", working}
+
+	tests := []struct {
+		name    string
+		args    []string
+		success bool
+	}{
+		{name: "no command", args: global},
+		{name: "unknown command", args: append(global, "unknown")},
+		{name: "unknown global flag", args: []string{"-unknown", "list"}},
+		{name: "missing original", args: []string{"-processed", "memory", "-working", working, "list"}},
+		{name: "missing processed", args: []string{"-original", "memory", "-working", working, "list"}},
+		{name: "missing config file", args: []string{"-config", working + "/missing.json", "list"}},
+		{name: "put without filename", args: append(global, "put")},
+		{name: "get without filename", args: append(global, "get")},
+		{name: "get with unknown flag", args: append(global, "get", "-x", "notes")},
+		{name: "probe without filename", args: append(global, "probe")},
+		{name: "delete without filename", args: append(global, "delete")},
+		{name: "variants without filename", args: append(global, "variants")},
+		{name: "warm without variants", args: append(global, "warm")},
+		{name: "gc with arguments", args: append(global, "gc", "extra")},
+		{name: "verify with arguments", args: append(global, "verify", "extra")},
+		{name: "list", args: append(global, "list"), success: true},
+		{name: "list with prefix", args: append(global, "list", "folder/"), success: true},
+		{name: "gc", args: append(global, "gc", "-max-bytes", "1000"), success: true},
+		{name: "verify", args: append(global, "verify"), success: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			err := run(test.args)
+
+			if test.success {
+				require.Nil(t, err)
+			} else {
+				require.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestVariantFlags(t *testing.T) {
+
+	tests := []struct {
+		value     string
+		extension string
+		width     int
+		height    int
+		bitrate   int
+	}{
+		{value: "webp", extension: ".webp"},
+		{value: ".webp", extension: ".webp"},
+		{value: "webp?w=300&h=200", extension: ".webp", width: 300, height: 200},
+		{value: "mp3?b=128", extension: ".mp3", bitrate: 128},
+	}
+
+	for _, test := range tests {
+
+		variants := variantFlags{}
+		require.Nil(t, variants.Set(test.value))
+		require.Equal(t, 1, len(variants))
+		require.Equal(t, test.extension, variants[0].Extension, test.value)
+		require.Equal(t, test.width, variants[0].Width, test.value)
+		require.Equal(t, test.height, variants[0].Height, test.value)
+		require.Equal(t, test.bitrate, variants[0].Bitrate, test.value)
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	app := newTestApplication(t)
+
+	require.Nil(t, app.server.Put("notes", strings.NewReader("hello world")))
+	require.Nil(t, afero.WriteFile(app.processed, "notes/cached.txt", []byte("hello world"), 0666))
+	require.Nil(t, app.verify(nil))
+
+	// Empty and orphaned processed files are both problems
+	require.Nil(t, afero.WriteFile(app.processed, "notes/cached.webp", []byte{}, 0666))
+	require.Nil(t, afero.WriteFile(app.processed, "missing/cached.txt", []byte("hello world"), 0666))
+
+	err := app.verify(nil)
+	require.NotNil(t, err)
+	require.Equal(t, "found 2 problems", err.Error())
+
+	// Hidden staging areas are not checked
+	require.Nil(t, app.processed.Remove("notes/cached.webp"))
+	require.Nil(t, app.processed.Remove("missing/cached.txt"))
+	require.Nil(t, afero.WriteFile(app.processed, ".uploads/partial", []byte{}, 0666))
+	require.Nil(t, app.verify(nil))
+}
+
+func TestGC(t *testing.T) {
+
+	app := newTestApplication(t)
+
+	require.Nil(t, app.server.Put("notes", strings.NewReader("hello world")))
+	require.Nil(t, afero.WriteFile(app.processed, "notes/cached.txt", []byte("hello world"), 0666))
+	require.Nil(t, afero.WriteFile(app.processed, "missing/cached.txt", []byte("hello world"), 0666))
+	require.Nil(t, afero.WriteFile(app.processed, ".uploads/partial", []byte("partial"), 0666))
+
+	require.Nil(t, app.gc(nil))
+
+	// Orphaned processed files are removed
+	exists, err := afero.Exists(app.processed, "missing/cached.txt")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// Processed files with an original, and hidden staging areas, are kept
+	exists, err = afero.Exists(app.processed, "notes/cached.txt")
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	exists, err = afero.Exists(app.processed, ".uploads/partial")
+	require.Nil(t, err)
+	require.True(t, exists)
+}
+
+func TestGC_DotFolder(t *testing.T) {
+
+	app := newTestApplication(t)
+
+	// Filesystems may be stored in hidden folders, such as "./.media"
+	folder := filepath.Join(t.TempDir(), ".media")
+	require.Nil(t, os.MkdirAll(filepath.Join(folder, "missing"), 0777))
+	require.Nil(t, os.WriteFile(filepath.Join(folder, "missing", "cached.txt"), []byte("hello world"), 0666))
+	app.processed = afero.NewBasePathFs(afero.NewOsFs(), folder)
+
+	require.NotNil(t, app.verify(nil))
+	require.Nil(t, app.gc(nil))
+	require.NoFileExists(t, filepath.Join(folder, "missing", "cached.txt"))
+}
+
+// newTestApplication returns an application that works with in-memory filesystems
+func newTestApplication(t *testing.T) application {
+
+	working := mediaserver.NewWorkingDirectory(t.TempDir(), time.Minute, 100)
+	t.Cleanup(working.Close)
+
+	original := afero.NewMemMapFs()
+	processed := afero.NewMemMapFs()
+
+	return application{
+		server:    mediaserver.New(original, processed, &working),
+		original:  original,
+		processed: processed,
+		working:   &working,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// config describes the filesystems that the command line tool works with
+type config struct {
+	Original  string `json:"original"`
+	Processed string `json:"processed"`
+	Working   string `json:"working"`
+}
+
+// loadConfig reads a JSON config file.  An empty filename returns an empty config.
+func loadConfig(filename string) (config, error) {
+
+	result := config{}
+
+	if filename == "" {
+		return result, nil
+	}
+
+	data, err := os.ReadFile(filename)
+
+	if err != nil {
+		return result, fmt.Errorf("unable to read config file %s: %w", filename, err)
+	}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return result, fmt.Errorf("unable to parse config file %s: %w", filename, err)
+	}
+
+	return result, nil
+}
+
+// override replaces config values with any non-empty command line values
+func (c *config) override(original string, processed string, working string) {
+
+	if original != "" {
+		c.Original = original
+	}
+
+	if processed != "" {
+		c.Processed = processed
+	}
+
+	if working != "" {
+		c.Working = working
+	}
+}
+
+func (c config) originalFs() (afero.Fs, error) {
+	return newFilesystem("original", c.Original)
+}
+
+func (c config) processedFs() (afero.Fs, error) {
+	return newFilesystem("processed", c.Processed)
+}
+
+// newFilesystem returns an afero filesystem for a configured location
+func newFilesystem(name string, location string) (afero.Fs, error) {
+
+	switch location {
+
+	case "":
+		return nil, fmt.Errorf("the %s location is required", name)
+
+	case "memory":
+		return afero.NewMemMapFs(), nil
+	}
+
+	if err := os.MkdirAll(location, 0777); err != nil {
+		return nil, fmt.Errorf("unable to create %s directory %s: %w", name, location, err)
+	}
+
+	return afero.NewBasePathFs(afero.NewOsFs(), location), nil
+}
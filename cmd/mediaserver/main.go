@@ -0,0 +1,142 @@
+// Command mediaserver inspects and manages a media store from the command line.
+//
+// Usage:
+//
+//	mediaserver [global flags] <command> [command flags] [arguments]
+//
+// Global flags select the filesystems to work with.  Each one may be a local
+// directory, or "memory" for a (temporary) in-memory filesystem.  Defaults are
+// read from the MEDIASERVER_ORIGINAL, MEDIASERVER_PROCESSED, and
+// MEDIASERVER_WORKING environment variables, or from a JSON config file.
+//
+// Commands:
+//
+//	put      <filename> [source]     uploads a file (from source, or stdin)
+//	get      <filename>              writes a processed variant of a file (to -o, or stdout)
+//	probe    <filename>              prints ffprobe information about an original file
+//	delete   <filename>...           removes original files and all of their variants
+//	list     [prefix]                lists original files
+//	variants <filename>              lists the processed variants of an original file
+//	warm     [filename...]           generates processed variants for original files
+//	gc                               removes orphaned processed files, and evicts files over size or age limits
+//	verify                           checks that all original and processed files are readable
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/benpate/mediaserver"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "mediaserver:", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the global flags and dispatches to the requested command
+func run(args []string) error {
+
+	flags := flag.NewFlagSet("mediaserver", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: mediaserver [global flags] <put|get|probe|delete|list|variants|warm|gc|verify> [command flags] [arguments]")
+		flags.PrintDefaults()
+	}
+
+	configFile := flags.String("config", os.Getenv("MEDIASERVER_CONFIG"), "JSON config file containing \"original\", \"processed\", and \"working\" locations")
+	original := flags.String("original", os.Getenv("MEDIASERVER_ORIGINAL"), "location of original files")
+	processed := flags.String("processed", os.Getenv("MEDIASERVER_PROCESSED"), "location of processed files")
+	working := flags.String("working", os.Getenv("MEDIASERVER_WORKING"), "location of working files (defaults to a folder in the system temp directory)")
+	verbose := flags.Bool("v", false, "write trace logs to stderr")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *verbose {
+		zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("a command is required")
+	}
+
+	// Load configuration, letting command line flags override the config file
+	config, err := loadConfig(*configFile)
+
+	if err != nil {
+		return err
+	}
+
+	config.override(*original, *processed, *working)
+
+	// Build the filesystems and the MediaServer
+	originalFs, err := config.originalFs()
+
+	if err != nil {
+		return err
+	}
+
+	processedFs, err := config.processedFs()
+
+	if err != nil {
+		return err
+	}
+
+	workingDirectory := mediaserver.NewWorkingDirectory(config.Working, time.Hour, 1000)
+	defer workingDirectory.Close()
+
+	server := mediaserver.New(originalFs, processedFs, &workingDirectory)
+
+	app := application{
+		server:    server,
+		original:  originalFs,
+		processed: processedFs,
+		working:   &workingDirectory,
+	}
+
+	// Dispatch to the requested command
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+
+	switch command {
+
+	case "put":
+		return app.put(commandArgs)
+
+	case "get":
+		return app.get(commandArgs)
+
+	case "probe":
+		return app.probe(commandArgs)
+
+	case "delete":
+		return app.delete(commandArgs)
+
+	case "list":
+		return app.list(commandArgs)
+
+	case "variants":
+		return app.variants(commandArgs)
+
+	case "warm":
+		return app.warm(commandArgs)
+
+	case "gc":
+		return app.gc(commandArgs)
+
+	case "verify":
+		return app.verify(commandArgs)
+	}
+
+	flags.Usage()
+	return fmt.Errorf("unrecognized command: %s", command)
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package mediaserver
+
+// freeDiskSpace cannot measure free disk space on this platform, so it always returns FALSE.
+func freeDiskSpace(folder string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package mediaserver
+
+import "syscall"
+
+// freeDiskSpace returns the number of bytes available to unprivileged users on the disk
+// that contains the provided folder.  It returns FALSE if the value cannot be measured.
+func freeDiskSpace(folder string) (int64, bool) {
+
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(folder, &stat); err != nil {
+		return 0, false
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
@@ -0,0 +1,129 @@
+package mediaserver
+
+import "net/http"
+
+// SignatureError is returned when a FileSpec URL is unsigned, tampered with, or expired.
+type SignatureError struct {
+	Reason string // Human-readable reason that the signature was rejected
+}
+
+func (err SignatureError) Error() string {
+	return "mediaserver: invalid signature: " + err.Reason
+}
+
+// GetErrorCode implements the derp.ErrorCodeGetter interface
+func (err SignatureError) GetErrorCode() int {
+	return http.StatusForbidden
+}
+
+// FileSpecError is returned when a FileSpec requests a value that is not allowed by a Policy.
+type FileSpecError struct {
+	Field  string // Name of the FileSpec field that was rejected
+	Value  any    // Value that was rejected
+	Reason string // Human-readable reason that the value was rejected
+}
+
+func (err FileSpecError) Error() string {
+	return "mediaserver: invalid " + err.Field + ": " + err.Reason
+}
+
+// GetErrorCode implements the derp.ErrorCodeGetter interface
+func (err FileSpecError) GetErrorCode() int {
+	return http.StatusBadRequest
+}
+
+// FilenameError is returned when a filename is not safe to use with the MediaServer's filesystems.
+type FilenameError struct {
+	Filename string // Filename that was rejected
+	Reason   string // Human-readable reason that the filename was rejected
+}
+
+func (err FilenameError) Error() string {
+	return "mediaserver: invalid filename: " + err.Reason
+}
+
+// GetErrorCode implements the derp.ErrorCodeGetter interface
+func (err FilenameError) GetErrorCode() int {
+	return http.StatusBadRequest
+}
+
+// QuotaError is returned when a Put would exceed the Quota of a Namespace.
+type QuotaError struct {
+	Namespace string // Namespace whose Quota would be exceeded
+	Quota     Quota  // Quota of the Namespace
+	Usage     Usage  // Usage of the Namespace before the Put
+	Reason    string // Human-readable reason that the Put was rejected
+}
+
+func (err QuotaError) Error() string {
+	return "mediaserver: quota exceeded for namespace " + err.Namespace + ": " + err.Reason
+}
+
+// GetErrorCode implements the derp.ErrorCodeGetter interface
+func (err QuotaError) GetErrorCode() int {
+	return http.StatusInsufficientStorage
+}
+
+// UploadError is returned when an upload is rejected because it is too large, is not an
+// allowed type, or cannot be decoded.
+type UploadError struct {
+	Filename string // Filename of the rejected upload
+	Code     int    // HTTP status code that describes the rejection
+	Reason   string // Human-readable reason that the upload was rejected
+}
+
+func (err UploadError) Error() string {
+	return "mediaserver: upload rejected: " + err.Reason
+}
+
+// GetErrorCode implements the derp.ErrorCodeGetter interface
+func (err UploadError) GetErrorCode() int {
+	return err.Code
+}
+
+// ChecksumError is returned when the digest of an upload does not match the digest that was expected.
+type ChecksumError struct {
+	Filename string // Filename of the rejected upload
+	Expected string // Digest that the client expected (hex encoded)
+	Actual   string // Digest of the contents that were received (hex encoded)
+}
+
+func (err ChecksumError) Error() string {
+	return "mediaserver: checksum mismatch: expected " + err.Expected + " but received " + err.Actual
+}
+
+// GetErrorCode implements the derp.ErrorCodeGetter interface
+func (err ChecksumError) GetErrorCode() int {
+	return http.StatusBadRequest
+}
+
+// ConflictError is returned when a conditional Put does not match the current state of the
+// original file, such as a create-only Put for a file that already exists.
+type ConflictError struct {
+	Filename string // Filename of the rejected upload
+	Reason   string // Human-readable reason that the upload was rejected
+}
+
+func (err ConflictError) Error() string {
+	return "mediaserver: conflict: " + err.Reason
+}
+
+// GetErrorCode implements the derp.ErrorCodeGetter interface
+func (err ConflictError) GetErrorCode() int {
+	return http.StatusPreconditionFailed
+}
+
+// InfectedError is returned when a Scanner finds a virus (or other unwanted content) in an upload.
+type InfectedError struct {
+	Filename  string // Filename of the rejected upload
+	Signature string // Name of the signature that matched, as reported by the Scanner
+}
+
+func (err InfectedError) Error() string {
+	return "mediaserver: infected upload: " + err.Signature
+}
+
+// GetErrorCode implements the derp.ErrorCodeGetter interface
+func (err InfectedError) GetErrorCode() int {
+	return http.StatusUnprocessableEntity
+}
@@ -0,0 +1,89 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os/exec"
+)
+
+// ProbeResult contains the (parsed) output of ffprobe
+type ProbeResult struct {
+	Format  ProbeFormat   `json:"format"`
+	Streams []ProbeStream `json:"streams"`
+}
+
+// ProbeFormat describes the container format of a media file
+type ProbeFormat struct {
+	Filename   string            `json:"filename"`
+	FormatName string            `json:"format_name"`
+	Duration   string            `json:"duration"`
+	Size       string            `json:"size"`
+	BitRate    string            `json:"bit_rate"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// ProbeStream describes a single audio, video, or image stream within a media file
+type ProbeStream struct {
+	Index      int               `json:"index"`
+	CodecType  string            `json:"codec_type"`
+	CodecName  string            `json:"codec_name"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	SampleRate string            `json:"sample_rate"`
+	Channels   int               `json:"channels"`
+	Duration   string            `json:"duration"`
+	BitRate    string            `json:"bit_rate"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// ProbeIsInstalled is set to true if ffprobe is installed on the server
+var ProbeIsInstalled = false
+
+func init() {
+
+	// Check to see if ffprobe is installed
+	if _, err := exec.LookPath("ffprobe"); err == nil {
+		ProbeIsInstalled = true
+	}
+}
+
+// Probe runs ffprobe on a local file and returns the parsed results.
+// An error is returned if ffprobe is not installed, or if the file cannot be decoded.
+func Probe(filename string) (ProbeResult, error) {
+
+	result := ProbeResult{}
+
+	if !ProbeIsInstalled {
+		return result, errors.New("ffprobe is not installed on this server")
+	}
+
+	var output bytes.Buffer
+	var errorOutput bytes.Buffer
+
+	command := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", filename)
+	command.Stdout = &output
+	command.Stderr = &errorOutput
+
+	if err := command.Run(); err != nil {
+		return result, errors.Join(err, errors.New(errorOutput.String()))
+	}
+
+	if err := json.Unmarshal(output.Bytes(), &result); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// HasStream returns TRUE if the probed file contains at least one stream of the requested type ("audio", "video")
+func (result ProbeResult) HasStream(codecType string) bool {
+
+	for _, stream := range result.Streams {
+		if stream.CodecType == codecType {
+			return true
+		}
+	}
+
+	return false
+}
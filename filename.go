@@ -0,0 +1,99 @@
+package mediaserver
+
+import (
+	"strings"
+)
+
+// DefaultFilenameCharacters are the punctuation characters that are allowed in filenames
+// (in addition to ASCII letters, digits, and the "/" separator) unless WithFilenameCharacters is used.
+const DefaultFilenameCharacters = "-_."
+
+// MaxFilenameLength is the longest filename (in bytes) that the MediaServer will accept.
+const MaxFilenameLength = 255
+
+// WithFilenameCharacters replaces the punctuation characters that are allowed in filenames.
+// ASCII letters, digits, and the "/" separator are always allowed.
+func WithFilenameCharacters(characters string) Option {
+	return func(ms *MediaServer) {
+		ms.filenameCharacters = characters
+	}
+}
+
+// ValidateFilename returns a FilenameError if the filename is not safe to pass to the
+// original and processed filesystems.  Filenames are relative, slash-separated paths.
+// Each segment must be non-empty, must not begin with a "." (which excludes "." and ".."
+// and reserves hidden names for the MediaServer), and may only contain ASCII letters,
+// digits, and the allowed punctuation characters.
+func (ms MediaServer) ValidateFilename(filename string) error {
+
+	if filename == "" {
+		return FilenameError{Filename: filename, Reason: "filename is required"}
+	}
+
+	if len(filename) > MaxFilenameLength {
+		return FilenameError{Filename: filename, Reason: "filename is too long"}
+	}
+
+	for _, segment := range strings.Split(filename, "/") {
+
+		if segment == "" {
+			return FilenameError{Filename: filename, Reason: "filename must be a relative path without empty segments"}
+		}
+
+		if strings.HasPrefix(segment, ".") {
+			return FilenameError{Filename: filename, Reason: "filename segments must not begin with '.'"}
+		}
+
+		for _, character := range segment {
+			if !isAlphanumeric(character) && !strings.ContainsRune(ms.filenameCharacters, character) {
+				return FilenameError{Filename: filename, Reason: "filename contains an invalid character: " + string(character)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateFileSpec returns a FilenameError if the filename or extensions in the FileSpec
+// are not safe to use in filesystem paths.
+func (ms MediaServer) validateFileSpec(filespec FileSpec) error {
+
+	if err := ms.ValidateFilename(filespec.Filename); err != nil {
+		return err
+	}
+
+	if !isValidExtension(filespec.Extension) {
+		return FilenameError{Filename: filespec.Filename, Reason: "extension contains invalid characters: " + filespec.Extension}
+	}
+
+	if !isValidExtension(filespec.OriginalExtension) {
+		return FilenameError{Filename: filespec.Filename, Reason: "original extension contains invalid characters: " + filespec.OriginalExtension}
+	}
+
+	return nil
+}
+
+// isValidExtension returns TRUE if the extension is empty, or is a "." followed by ASCII letters and digits
+func isValidExtension(extension string) bool {
+
+	if extension == "" {
+		return true
+	}
+
+	if (len(extension) < 2) || (extension[0] != '.') {
+		return false
+	}
+
+	for _, character := range extension[1:] {
+		if !isAlphanumeric(character) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isAlphanumeric returns TRUE if the character is an ASCII letter or digit
+func isAlphanumeric(character rune) bool {
+	return (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z') || (character >= '0' && character <= '9')
+}
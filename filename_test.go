@@ -0,0 +1,75 @@
+package mediaserver
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFilename(t *testing.T) {
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), nil)
+
+	valid := []string{"file", "file.txt", "folder/file-name_2", "a/b/c"}
+
+	for _, filename := range valid {
+		require.Nil(t, ms.ValidateFilename(filename), filename)
+	}
+
+	invalid := []string{"", "/absolute", "../escape", "folder/../../escape", "folder//file", "./file", ".hidden", "folder/.uploads/file", "back\\slash", "space name", "nul\x00", "percent%2F", strings.Repeat("a", MaxFilenameLength+1)}
+
+	for _, filename := range invalid {
+		err := ms.ValidateFilename(filename)
+		require.IsType(t, FilenameError{}, err, filename)
+		require.Equal(t, http.StatusBadRequest, derp.ErrorCode(err), filename)
+	}
+
+	// Allowed punctuation is configurable
+	ms = New(afero.NewMemMapFs(), afero.NewMemMapFs(), nil, WithFilenameCharacters("-_.@ "))
+	require.Nil(t, ms.ValidateFilename("user@example/space name"))
+	require.NotNil(t, ms.ValidateFilename("../escape"))
+}
+
+func TestValidateFilename_API(t *testing.T) {
+
+	original := afero.NewMemMapFs()
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(original, afero.NewMemMapFs(), &working)
+
+	require.Nil(t, afero.WriteFile(original, "secret", []byte("secret"), 0666))
+
+	// Every public method rejects unsafe filenames before touching the filesystem
+	badRequest := func(err error) {
+		require.Equal(t, http.StatusBadRequest, derp.ErrorCode(err), err)
+	}
+
+	badRequest(ms.Put("../secret", strings.NewReader("overwrite")))
+	badRequest(ms.Delete("../secret"))
+	badRequest(ms.PurgeVariants("../secret"))
+
+	_, err := ms.Variants("../secret")
+	badRequest(err)
+
+	_, err = ms.Version("../secret")
+	badRequest(err)
+
+	_, err = ms.DetectMimeType("../secret")
+	badRequest(err)
+
+	filespec := NewFileSpec()
+	filespec.Filename = "secret"
+	filespec.Extension = "/../../escape"
+	badRequest(ms.Generate(filespec))
+
+	// The original file is untouched
+	exists, err := afero.Exists(original, "secret")
+	require.Nil(t, err)
+	require.True(t, exists)
+}
@@ -1,7 +1,11 @@
 package mediaserver
 
 import (
+	"hash/fnv"
 	"mime"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/benpate/rosetta/convert"
@@ -9,6 +13,11 @@ import (
 	"github.com/benpate/rosetta/mapof"
 )
 
+// PipelineRevision is included in the cache key of every processed file.  Increment it when
+// processing changes in ways that are not visible in the FFmpeg arguments (such as a new
+// FFmpeg build) so that all processed files are regenerated.
+const PipelineRevision = 1
+
 // FileSpec represents all the parameters available for requesting a file.
 // This can be generated directly from a URL.
 type FileSpec struct {
@@ -18,8 +27,11 @@ type FileSpec struct {
 	Width             int          // For images and videos, the requested width
 	Height            int          // For images and videos, the requested height
 	Bitrate           int          // For audio and videos, the audio bitrage
+	Version           string       // Version of the original file (see MediaServer.Version) so that replaced originals get new cache keys
 	Metadata          mapof.String // Metadata to add to the outbound file
 	Cache             bool         // If TRUE, then allow caching
+
+	pipeline string // Pipeline version parsed from an existing processed filename (see pipelineVersion)
 }
 
 func NewFileSpec() FileSpec {
@@ -28,6 +40,63 @@ func NewFileSpec() FileSpec {
 	}
 }
 
+// ParseFileSpec generates a FileSpec from the path and query string of a URL.
+// The path names the original file, and its extension (if any) is the requested output format.
+// Query parameters "w", "h", and "b" set the requested width, height, and bitrate,
+// and "v" sets the version of the original file.
+func ParseFileSpec(requestPath string, query url.Values) FileSpec {
+
+	result := NewFileSpec()
+	result.Extension = path.Ext(requestPath)
+	result.Filename = strings.TrimSuffix(requestPath, result.Extension)
+	result.Width = convert.Int(query.Get("w"))
+	result.Height = convert.Int(query.Get("h"))
+	result.Bitrate = convert.Int(query.Get("b"))
+	result.Cache = true
+
+	if version := query.Get("v"); isValidVersion(version) {
+		result.Version = version
+	}
+
+	return result
+}
+
+// URL returns the relative URL (path and query string) that ParseFileSpec will turn back into this FileSpec.
+func (filespec *FileSpec) URL() string {
+
+	query := filespec.query()
+
+	if len(query) == 0 {
+		return filespec.DownloadFilename()
+	}
+
+	return filespec.DownloadFilename() + "?" + query.Encode()
+}
+
+// query returns the URL query parameters that describe this FileSpec
+func (filespec *FileSpec) query() url.Values {
+
+	result := url.Values{}
+
+	if filespec.Width != 0 {
+		result.Set("w", convert.String(filespec.Width))
+	}
+
+	if filespec.Height != 0 {
+		result.Set("h", convert.String(filespec.Height))
+	}
+
+	if filespec.Bitrate != 0 {
+		result.Set("b", convert.String(filespec.Bitrate))
+	}
+
+	if filespec.Version != "" {
+		result.Set("v", filespec.Version)
+	}
+
+	return result
+}
+
 // DownloadFilename returns the name that should be used when downloading the file.
 func (filespec *FileSpec) DownloadFilename() string {
 	return filespec.Filename + filespec.Extension
@@ -99,6 +168,168 @@ func (filespec *FileSpec) writeFilenameArgs(buffer *strings.Builder) {
 			buffer.WriteString("_b" + convert.String(filespec.Bitrate))
 		}
 	}
+
+	if isValidVersion(filespec.Version) {
+		buffer.WriteString("_v" + filespec.Version)
+	}
+
+	if pipeline := filespec.pipelineVersion(); pipeline != "" {
+		buffer.WriteString("_p" + pipeline)
+	}
+}
+
+// pipelineVersion returns a short hash of the processing pipeline (PipelineRevision
+// and FFmpeg arguments) so that changes to the pipeline create new cache keys.
+// Files that are copied without FFmpeg processing return an empty string.
+func (filespec *FileSpec) pipelineVersion() string {
+
+	// Use a copy, because ffmpegArguments may update the extension
+	clone := *filespec
+	args := clone.ffmpegArguments()
+
+	if len(args) == 0 {
+		return ""
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(strconv.Itoa(PipelineRevision)))
+
+	for _, arg := range args {
+		hash.Write([]byte{0})
+		hash.Write([]byte(arg))
+	}
+
+	return strconv.FormatUint(uint64(hash.Sum32()), 36)
+}
+
+// parseProcessedFilename reverses ProcessedFilename, returning a FileSpec for the named original file.
+// It returns FALSE if the name was not created by ProcessedFilename.
+func parseProcessedFilename(filename string, processedFilename string) (FileSpec, bool) {
+
+	args, ok := strings.CutPrefix(processedFilename, "cached")
+
+	if !ok {
+		return FileSpec{}, false
+	}
+
+	return parseFilenameArgs(filename, args)
+}
+
+// parseWorkingFilename reverses WorkingFilename, returning a FileSpec for the named original file.
+// It returns FALSE if the name was not created by WorkingFilename for this original file.
+func parseWorkingFilename(filename string, workingFilename string) (FileSpec, bool) {
+
+	args, ok := strings.CutPrefix(workingFilename, filename)
+
+	if !ok {
+		return FileSpec{}, false
+	}
+
+	result, ok := parseFilenameArgs(filename, args)
+
+	if !ok {
+		return FileSpec{}, false
+	}
+
+	// Names like "cat_w1_p123.jpg" could also belong to other originals (such as "cat_w1"),
+	// so only accept the exact name that a variant of this original would use
+	if result.WorkingFilename() != workingFilename {
+		return FileSpec{}, false
+	}
+
+	return result, true
+}
+
+// parseFilenameArgs reverses writeFilenameArgs (plus the file extension)
+func parseFilenameArgs(filename string, args string) (FileSpec, bool) {
+
+	result := NewFileSpec()
+	result.Filename = filename
+	result.Cache = true
+
+	// Split off the extension (which must not include any path separators)
+	if index := strings.LastIndex(args, "."); index >= 0 {
+		result.Extension = args[index:]
+		args = args[:index]
+
+		if strings.ContainsAny(result.Extension, "/_") {
+			return FileSpec{}, false
+		}
+	}
+
+	if args == "" {
+		return result, true
+	}
+
+	// Remaining values must look like "_w300_h300_b128"
+	if !strings.HasPrefix(args, "_") {
+		return FileSpec{}, false
+	}
+
+	for _, arg := range strings.Split(args[1:], "_") {
+
+		if len(arg) < 2 {
+			return FileSpec{}, false
+		}
+
+		switch arg[0] {
+
+		case 'v':
+			if !isValidVersion(arg[1:]) {
+				return FileSpec{}, false
+			}
+
+			result.Version = arg[1:]
+			continue
+
+		case 'p':
+			if !isValidVersion(arg[1:]) {
+				return FileSpec{}, false
+			}
+
+			result.pipeline = arg[1:]
+			continue
+		}
+
+		value, err := strconv.Atoi(arg[1:])
+
+		if err != nil {
+			return FileSpec{}, false
+		}
+
+		switch arg[0] {
+
+		case 'w':
+			result.Width = value
+
+		case 'h':
+			result.Height = value
+
+		case 'b':
+			result.Bitrate = value
+
+		default:
+			return FileSpec{}, false
+		}
+	}
+
+	return result, true
+}
+
+// isValidVersion returns TRUE if the version is safe to include in filenames (only lowercase letters and digits)
+func isValidVersion(version string) bool {
+
+	if version == "" {
+		return false
+	}
+
+	for _, character := range version {
+		if !((character >= 'a' && character <= 'z') || (character >= '0' && character <= '9')) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (filespec *FileSpec) AspectRatio() float64 {
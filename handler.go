@@ -0,0 +1,349 @@
+package mediaserver
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/benpate/derp"
+)
+
+// Action identifies the kind of operation that an HTTP request is trying to perform.
+type Action string
+
+// ActionRead is a request to download a processed variant of a file
+const ActionRead Action = "read"
+
+// ActionReadOriginal is a request to download an original file
+const ActionReadOriginal Action = "read-original"
+
+// ActionWrite is a request to upload a new (or replacement) original file
+const ActionWrite Action = "write"
+
+// ActionDelete is a request to remove an original file and all of its variants
+const ActionDelete Action = "delete"
+
+// Authorizer is a hook that approves or rejects an HTTP request before the Handler acts on it.
+// Return a derp.Error (such as derp.Unauthorized or derp.Forbidden) to set the HTTP status code.
+type Authorizer func(request *http.Request, action Action, filename string) error
+
+// Handler is an http.Handler that exposes a MediaServer over HTTP.
+// It is designed to be mounted under a prefix, using http.StripPrefix:
+//
+//	GET    /{filename}.{ext}?w=&h=&b=  serves a processed variant of the file
+//	GET    /{filename}?ext=&w=&h=&b=   serves a processed variant of the file (for filenames that contain a dot)
+//	GET    /{filename}?preset=name     serves a processed variant of the file using a named Preset
+//	GET    /{filename}                 serves the original file
+//	PUT    /{filename}                 uploads the request body as the original file (verifying any Content-Digest, If-Match, and If-None-Match headers)
+//	POST   /{filename}                 uploads the request body (or a multipart "file" field)
+//	DELETE /{filename}                 removes the original file and all of its variants
+//
+// GET requests use the same filenames as PUT and DELETE: if the whole path names an existing
+// original file, then it refers to that file.  Otherwise, the extension of the path is the
+// requested output format of the original file without it.
+type Handler struct {
+	server      MediaServer
+	authorizers []Authorizer
+}
+
+// HandlerOption modifies a Handler
+type HandlerOption func(*Handler)
+
+// NewHandler returns a fully initialized Handler
+func NewHandler(server MediaServer, options ...HandlerOption) Handler {
+
+	result := Handler{
+		server:      server,
+		authorizers: make([]Authorizer, 0),
+	}
+
+	for _, option := range options {
+		option(&result)
+	}
+
+	return result
+}
+
+// WithAuthorizer adds an Authorizer hook to the Handler.
+// If multiple Authorizers are added, then every one of them must approve each request.
+func WithAuthorizer(authorizer Authorizer) HandlerOption {
+	return func(handler *Handler) {
+		handler.authorizers = append(handler.authorizers, authorizer)
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (handler Handler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+
+	writer := &handlerResponseWriter{ResponseWriter: responseWriter}
+	filename := strings.TrimPrefix(request.URL.Path, "/")
+
+	if filename == "" {
+		writeError(writer, derp.NotFound("mediaserver.Handler.ServeHTTP", "Filename is required"))
+		return
+	}
+
+	var err error
+
+	switch request.Method {
+
+	case http.MethodGet, http.MethodHead:
+		err = handler.get(writer, request, filename)
+
+	case http.MethodPut, http.MethodPost:
+		err = handler.put(writer, request, filename)
+
+	case http.MethodDelete:
+		err = handler.delete(writer, request, filename)
+
+	default:
+		writer.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		err = derp.BadRequest("mediaserver.Handler.ServeHTTP", "Method not allowed", request.Method, derp.WithCode(http.StatusMethodNotAllowed))
+	}
+
+	if err != nil {
+		writeError(writer, err)
+	}
+}
+
+// get serves either a processed variant (if the path includes an extension) or the original file
+func (handler Handler) get(responseWriter http.ResponseWriter, request *http.Request, path string) error {
+
+	const location = "mediaserver.Handler.get"
+
+	filespec, err := handler.resolve(path, request.URL.Query())
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to resolve file", path)
+	}
+
+	// Named presets replace the dimensions and format in the URL
+	if presetName := request.URL.Query().Get("preset"); presetName != "" {
+
+		preset, err := handler.server.PresetFileSpec(filespec.Filename, presetName)
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to load preset", presetName, derp.WithBadRequest())
+		}
+
+		filespec = preset
+	}
+
+	// Paths without an extension return the original file
+	if filespec.Extension == "" {
+
+		if err := handler.authorize(request, ActionReadOriginal, filespec.Filename); err != nil {
+			return derp.Wrap(err, location, "Request is not authorized", filespec.Filename)
+		}
+
+		if err := handler.server.ServeOriginal(responseWriter, request, filespec.Filename); err != nil {
+			return derp.Wrap(err, location, "Unable to serve original file", filespec.Filename)
+		}
+
+		return nil
+	}
+
+	// Otherwise, serve a processed variant of the file
+	if err := handler.authorize(request, ActionRead, filespec.Filename); err != nil {
+		return derp.Wrap(err, location, "Request is not authorized", filespec.Filename)
+	}
+
+	originalExtension, err := handler.server.DetectExtension(filespec.Filename)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to detect original file type", filespec.Filename)
+	}
+
+	filespec.OriginalExtension = originalExtension
+
+	if err := handler.server.Serve(responseWriter, request, filespec); err != nil {
+		return derp.Wrap(err, location, "Unable to serve file", filespec)
+	}
+
+	return nil
+}
+
+// resolve turns a request path into a FileSpec.  Paths that name an existing original file
+// refer to that file, and only request a processed variant when the query includes "ext",
+// "w", "h", or "b".  Otherwise, the extension of the path is the requested output format.
+func (handler Handler) resolve(requestPath string, query url.Values) (FileSpec, error) {
+
+	if handler.server.ValidateFilename(requestPath) != nil {
+		return ParseFileSpec(requestPath, query), nil
+	}
+
+	if info, err := handler.server.statOriginal(requestPath); (err != nil) || info.IsDir() {
+		return ParseFileSpec(requestPath, query), nil
+	}
+
+	result := ParseFileSpec("", query)
+	result.Filename = requestPath
+
+	if extension := query.Get("ext"); extension != "" {
+		result.Extension = "." + strings.TrimPrefix(extension, ".")
+		return result, nil
+	}
+
+	// Resized variants default to the original file type
+	if result.Resize() || (result.Bitrate > 0) {
+
+		extension, err := handler.server.DetectExtension(requestPath)
+
+		if err != nil {
+			return result, derp.Wrap(err, "mediaserver.Handler.resolve", "Unable to detect original file type", requestPath)
+		}
+
+		result.Extension = extension
+	}
+
+	return result, nil
+}
+
+// put uploads a new original file from the request body
+func (handler Handler) put(responseWriter http.ResponseWriter, request *http.Request, filename string) error {
+
+	const location = "mediaserver.Handler.put"
+
+	if err := handler.authorize(request, ActionWrite, filename); err != nil {
+		return derp.Wrap(err, location, "Request is not authorized", filename)
+	}
+
+	var body io.Reader = request.Body
+
+	// Multipart POSTs read the upload from the "file" field
+	if mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+
+		file, _, err := request.FormFile("file")
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to read multipart upload", filename, derp.WithBadRequest())
+		}
+
+		defer func() {
+			if err := file.Close(); err != nil {
+				derp.Report(derp.Wrap(err, location, "Unable to close multipart upload", filename))
+			}
+		}()
+
+		body = file
+	}
+
+	// Verify the upload against the client's digest (if provided).  Multipart uploads
+	// are not checked, because the digest describes the entire multipart body.
+	options := make([]PutOption, 0, 1)
+
+	if header := request.Header.Get("Content-Digest"); (header != "") && (body == io.Reader(request.Body)) {
+
+		digest, err := ParseContentDigest(header)
+
+		if err != nil {
+			return derp.Wrap(err, location, "Invalid Content-Digest header", header)
+		}
+
+		if digest != "" {
+			options = append(options, WithExpectedDigest(digest))
+		}
+	}
+
+	// Conditional uploads: "If-None-Match: *" creates a new file, and "If-Match" replaces a matching file
+	if strings.TrimSpace(request.Header.Get("If-None-Match")) == "*" {
+		options = append(options, WithCreateOnly())
+	}
+
+	if header := request.Header.Get("If-Match"); header != "" {
+		options = append(options, WithIfMatch(strings.Split(header, ",")...))
+	}
+
+	if err := handler.server.Put(filename, body, options...); err != nil {
+		return derp.Wrap(err, location, "Unable to save file", filename)
+	}
+
+	responseWriter.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// delete removes an original file and all of its variants
+func (handler Handler) delete(responseWriter http.ResponseWriter, request *http.Request, filename string) error {
+
+	const location = "mediaserver.Handler.delete"
+
+	if err := handler.authorize(request, ActionDelete, filename); err != nil {
+		return derp.Wrap(err, location, "Request is not authorized", filename)
+	}
+
+	if err := handler.server.Delete(filename); err != nil {
+		return derp.Wrap(err, location, "Unable to delete file", filename)
+	}
+
+	responseWriter.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// authorize runs all Authorizer hooks for the request
+func (handler Handler) authorize(request *http.Request, action Action, filename string) error {
+	return authorize(handler.authorizers, request, action, filename)
+}
+
+// authorize runs every Authorizer hook for the request, stopping at the first rejection
+func authorize(authorizers []Authorizer, request *http.Request, action Action, filename string) error {
+
+	for _, authorizer := range authorizers {
+		if err := authorizer(request, action, filename); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeError reports an error and (if possible) writes a matching HTTP status code to the client
+func writeError(responseWriter *handlerResponseWriter, err error) {
+
+	statusCode := errorStatusCode(err)
+
+	if statusCode >= http.StatusInternalServerError {
+		derp.Report(err)
+	}
+
+	// If the response has already started, then there's nothing more to say.
+	if responseWriter.wroteHeader {
+		return
+	}
+
+	http.Error(responseWriter, http.StatusText(statusCode), statusCode)
+}
+
+// errorStatusCode maps an error into the HTTP status code that should be returned to the client
+func errorStatusCode(err error) int {
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return http.StatusNotFound
+	}
+
+	if code := derp.ErrorCode(err); (code >= 400) && (code <= 599) {
+		return code
+	}
+
+	return http.StatusInternalServerError
+}
+
+// handlerResponseWriter tracks whether a response has already been started,
+// so that errors are not written on top of partial responses.
+type handlerResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *handlerResponseWriter) WriteHeader(statusCode int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *handlerResponseWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(data)
+}
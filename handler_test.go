@@ -0,0 +1,136 @@
+package mediaserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working)
+	handler := http.StripPrefix("/media", NewHandler(ms))
+
+	// Upload a new file
+	{
+		request := httptest.NewRequest(http.MethodPut, "/media/notes", strings.NewReader("hello world"))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	}
+
+	// Download the original
+	{
+		request := httptest.NewRequest(http.MethodGet, "/media/notes", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "hello world", recorder.Body.String())
+	}
+
+	// Download a (non-media) variant
+	{
+		request := httptest.NewRequest(http.MethodGet, "/media/notes.txt", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "hello world", recorder.Body.String())
+	}
+
+	// Delete the file
+	{
+		request := httptest.NewRequest(http.MethodDelete, "/media/notes", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	}
+
+	// Missing files are "Not Found"
+	{
+		request := httptest.NewRequest(http.MethodGet, "/media/notes", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestHandler_Authorizer(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working)
+
+	readOnly := func(request *http.Request, action Action, filename string) error {
+		if action == ActionRead || action == ActionReadOriginal {
+			return nil
+		}
+		return derp.Forbidden("test", "Read only", action, filename)
+	}
+
+	handler := NewHandler(ms, WithAuthorizer(readOnly))
+
+	request := httptest.NewRequest(http.MethodPut, "/notes", strings.NewReader("hello world"))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestHandler_DottedFilename(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working)
+	handler := http.StripPrefix("/media", NewHandler(ms))
+
+	// Upload a file whose name includes an extension
+	{
+		request := httptest.NewRequest(http.MethodPut, "/media/notes.txt", strings.NewReader("hello world"))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	}
+
+	// GET uses the same name as PUT
+	{
+		request := httptest.NewRequest(http.MethodGet, "/media/notes.txt", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "hello world", recorder.Body.String())
+	}
+
+	// Variants of dotted names are requested with the "ext" query
+	{
+		request := httptest.NewRequest(http.MethodGet, "/media/notes.txt?ext=txt", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "hello world", recorder.Body.String())
+	}
+
+	// Delete the file
+	{
+		request := httptest.NewRequest(http.MethodDelete, "/media/notes.txt", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	}
+
+	{
+		request := httptest.NewRequest(http.MethodGet, "/media/notes.txt", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+}
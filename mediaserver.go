@@ -1,6 +1,8 @@
 package mediaserver
 
 import (
+	"sync"
+
 	"github.com/spf13/afero"
 )
 
@@ -9,14 +11,74 @@ type MediaServer struct {
 	original  afero.Fs          // Directory for original source files
 	processed afero.Fs          // Directory for files that have been processed (may be deleted)
 	working   *WorkingDirectory // Directory for temporary/working files
+	signer    *Signer           // Optional signer that FileSpec URLs must be verified against
+	policy    Policy            // Limits on the FileSpecs that will be processed
+	presets   *presetRegistry   // Named renditions that can be requested by name
+	workers   chan struct{}     // Optional semaphore that limits the number of concurrent FFmpeg processes
+	cache     *cacheManager     // Tracks the size and last access of processed files
+
+	filenameCharacters string             // Punctuation characters allowed in filenames (see ValidateFilename)
+	namespace          string             // Prefix of this Namespace view (empty for the MediaServer itself)
+	namespaces         *namespaceRegistry // Quotas and usage of every Namespace
+	cacheRoot          afero.Fs           // Unscoped processed filesystem, used by GC for every Namespace
+	uploadLimits       UploadLimits       // Default limits for every Put
+	contentAddressed   bool               // If TRUE, then original files are deduplicated by their contents
+	casLock            *sync.Mutex        // Protects the reference counts of content-addressed files
+	uploadLocks        *keyedMutex        // Serializes uploads to the same filename
+	normalization      Normalization      // Default normalization applied to uploaded images
+	scanner            Scanner            // Optional scanner that inspects every upload
+	quarantine         afero.Fs           // Optional filesystem that keeps infected uploads
+	background         *sync.WaitGroup    // Tracks variants that are generated in the background
 }
 
+// Option modifies a MediaServer
+type Option func(*MediaServer)
+
 // New returns a fully initialized MediaServer
-func New(original afero.Fs, processed afero.Fs, working *WorkingDirectory) MediaServer {
+func New(original afero.Fs, processed afero.Fs, working *WorkingDirectory, options ...Option) MediaServer {
 
-	return MediaServer{
+	result := MediaServer{
 		original:  original,
 		processed: processed,
 		working:   working,
+		presets:   newPresetRegistry(),
+		cache:     newCacheManager(),
+
+		filenameCharacters: DefaultFilenameCharacters,
+		namespaces:         newNamespaceRegistry(),
+		cacheRoot:          processed,
+		casLock:            &sync.Mutex{},
+		uploadLocks:        newKeyedMutex(),
+		background:         &sync.WaitGroup{},
+	}
+
+	for _, option := range options {
+		option(&result)
+	}
+
+	return result
+}
+
+// WithSigner requires that every FileSpec passed to Serve is signed by the provided Signer
+func WithSigner(signer Signer) Option {
+	return func(ms *MediaServer) {
+		ms.signer = &signer
+	}
+}
+
+// WithPolicy limits the FileSpecs that Serve will process
+func WithPolicy(policy Policy) Option {
+	return func(ms *MediaServer) {
+		ms.policy = policy
+	}
+}
+
+// WithWorkers limits the number of original files that can be processed at the same time.
+// Additional requests wait for a worker to become available.
+func WithWorkers(count int) Option {
+	return func(ms *MediaServer) {
+		if count > 0 {
+			ms.workers = make(chan struct{}, count)
+		}
 	}
 }
@@ -0,0 +1,303 @@
+package mediaserver
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// casFolder is the (hidden) folder in the original filesystem where content-addressed files are stored
+const casFolder = ".cas"
+
+// casPointerPrefix begins every pointer file that links a filename to its content-addressed file
+const casPointerPrefix = "mediaserver-cas:sha256:"
+
+// casPointerLength is the exact size of every pointer file
+const casPointerLength = len(casPointerPrefix) + 64
+
+// WithContentAddressing stores each original file once, no matter how many filenames it is
+// uploaded to.  File contents are stored by their SHA-256 digest (in a hidden ".cas" folder
+// in the original filesystem) and each filename holds a small pointer to its contents.
+// Contents are reference counted, and removed when the last filename that uses them is removed.
+// Reference counts are protected by an in-process lock, so only one MediaServer should
+// write to a content-addressed filesystem at a time.
+func WithContentAddressing() Option {
+	return func(ms *MediaServer) {
+		ms.contentAddressed = true
+	}
+}
+
+// openOriginal opens an original file, following content-addressed pointers
+func (ms MediaServer) openOriginal(filename string) (afero.File, error) {
+
+	if digest, ok := ms.readPointer(filename); ok {
+		return ms.original.Open(casBlobPath(digest))
+	}
+
+	return ms.original.Open(filename)
+}
+
+// statOriginal returns information about an original file, following content-addressed pointers.
+// The size of a content-addressed file is the size of its contents, and its modification time is
+// the time that the filename was last uploaded.
+func (ms MediaServer) statOriginal(filename string) (fs.FileInfo, error) {
+
+	info, err := ms.original.Stat(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	digest, ok := ms.readPointer(filename)
+
+	if !ok {
+		return info, nil
+	}
+
+	blobInfo, err := ms.original.Stat(casBlobPath(digest))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return casFileInfo{FileInfo: blobInfo, name: info.Name(), modTime: info.ModTime()}, nil
+}
+
+// readPointer returns the digest that a content-addressed pointer file links to.
+// It returns FALSE if content addressing is disabled, or if the file is not a pointer.
+func (ms MediaServer) readPointer(filename string) (string, bool) {
+
+	if !ms.contentAddressed {
+		return "", false
+	}
+
+	if info, err := ms.original.Stat(filename); (err != nil) || (info.Size() != int64(casPointerLength)) {
+		return "", false
+	}
+
+	content, err := afero.ReadFile(ms.original, filename)
+
+	if err != nil {
+		return "", false
+	}
+
+	return parsePointer(content)
+}
+
+// parsePointer returns the digest in the contents of a content-addressed pointer file.
+// It returns FALSE if the contents are not a pointer.  Uploads are never allowed to match
+// this format, so that a filename cannot be made to point at contents that it did not upload.
+func parsePointer(content []byte) (string, bool) {
+
+	if len(content) != casPointerLength {
+		return "", false
+	}
+
+	digest, ok := strings.CutPrefix(string(content), casPointerPrefix)
+
+	if !ok || !isSHA256(digest) {
+		return "", false
+	}
+
+	return digest, true
+}
+
+// storeContentAddressed moves a completed upload into the content-addressed folder (unless
+// identical contents are already stored there) and points the filename at it.  If createOnly
+// is TRUE, then it returns a ConflictError if the filename already exists.
+func (ms MediaServer) storeContentAddressed(filename string, tempPath string, digest string, createOnly bool) error {
+
+	const location = "mediaserver.storeContentAddressed"
+
+	ms.casLock.Lock()
+	defer ms.casLock.Unlock()
+
+	if createOnly {
+		if exists, _ := afero.Exists(ms.original, filename); exists {
+			return ConflictError{Filename: filename, Reason: "file already exists"}
+		}
+	}
+
+	blobPath := casBlobPath(digest)
+
+	if exists, err := afero.Exists(ms.original, blobPath); err != nil {
+		return derp.Wrap(err, location, "Unable to check for existing contents", digest)
+
+	} else if exists {
+
+		// Identical contents are already stored, so the upload is not needed
+		if err := ms.original.Remove(tempPath); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to remove duplicate upload", tempPath))
+		}
+
+	} else {
+
+		if err := ensureAferoFolderExists(ms.original, path.Dir(blobPath)); err != nil {
+			return derp.Wrap(err, location, "Unable to create content folder", blobPath)
+		}
+
+		if err := ms.original.Rename(tempPath, blobPath); err != nil {
+			return derp.Wrap(err, location, "Unable to move upload into content folder", blobPath)
+		}
+	}
+
+	if err := ms.retain(digest, 1); err != nil {
+		return derp.Wrap(err, location, "Unable to add reference", digest)
+	}
+
+	// Remember the contents that are being replaced, so that their reference can be released
+	previous, replaced := ms.readPointer(filename)
+
+	if folder := path.Dir(filename); folder != "." {
+		if err := ensureAferoFolderExists(ms.original, folder); err != nil {
+			return derp.Wrap(err, location, "Unable to create folder in 'original' filesystem", filename)
+		}
+	}
+
+	if err := ms.writePointer(filename, digest, createOnly); err != nil {
+
+		if releaseErr := ms.retain(digest, -1); releaseErr != nil {
+			derp.Report(derp.Wrap(releaseErr, location, "Unable to release contents", digest))
+		}
+
+		return derp.Wrap(err, location, "Unable to write pointer file", filename)
+	}
+
+	if replaced {
+		if err := ms.retain(previous, -1); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to release replaced contents", previous))
+		}
+	}
+
+	return nil
+}
+
+// writePointer links a filename to content-addressed contents.  If createOnly is TRUE,
+// then it returns a ConflictError if the filename already exists.
+func (ms MediaServer) writePointer(filename string, digest string, createOnly bool) error {
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+
+	if createOnly {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+
+	file, err := ms.original.OpenFile(filename, flags, 0666)
+
+	if err != nil {
+
+		if errors.Is(err, fs.ErrExist) {
+			return ConflictError{Filename: filename, Reason: "file already exists"}
+		}
+
+		return err
+	}
+
+	if _, err := file.Write([]byte(casPointerPrefix + digest)); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// removeOriginalFile removes an original file, releasing its content-addressed contents (if any)
+func (ms MediaServer) removeOriginalFile(filename string) error {
+
+	if !ms.contentAddressed {
+		return ms.original.Remove(filename)
+	}
+
+	ms.casLock.Lock()
+	defer ms.casLock.Unlock()
+
+	digest, ok := ms.readPointer(filename)
+
+	if err := ms.original.Remove(filename); err != nil {
+		return err
+	}
+
+	if ok {
+		if err := ms.retain(digest, -1); err != nil {
+			derp.Report(derp.Wrap(err, "mediaserver.removeOriginalFile", "Unable to release contents", digest))
+		}
+	}
+
+	return nil
+}
+
+// retain adds (or removes) references to content-addressed contents, removing the contents
+// once there are no references left.  The caller must hold casLock.
+func (ms MediaServer) retain(digest string, delta int) error {
+
+	const location = "mediaserver.retain"
+
+	refsPath := casBlobPath(digest) + ".refs"
+	refs := 0
+
+	if content, err := afero.ReadFile(ms.original, refsPath); err == nil {
+		refs, _ = strconv.Atoi(string(content))
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return derp.Wrap(err, location, "Unable to read reference count", refsPath)
+	}
+
+	refs += delta
+
+	if refs > 0 {
+		if err := afero.WriteFile(ms.original, refsPath, []byte(strconv.Itoa(refs)), 0666); err != nil {
+			return derp.Wrap(err, location, "Unable to write reference count", refsPath)
+		}
+		return nil
+	}
+
+	for _, filename := range []string{casBlobPath(digest), refsPath} {
+		if err := ms.original.Remove(filename); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+			return derp.Wrap(err, location, "Unable to remove unused contents", filename)
+		}
+	}
+
+	return nil
+}
+
+// casBlobPath returns the location of content-addressed contents, sharded by the first bytes of the digest
+func casBlobPath(digest string) string {
+	return path.Join(casFolder, digest[0:2], digest)
+}
+
+// isSHA256 returns TRUE if the value is a hex-encoded SHA-256 digest
+func isSHA256(value string) bool {
+
+	if len(value) != 64 {
+		return false
+	}
+
+	for _, character := range value {
+		if !((character >= '0' && character <= '9') || (character >= 'a' && character <= 'f')) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// casFileInfo reports the name and modification time of a pointer file, with the size of its contents
+type casFileInfo struct {
+	fs.FileInfo
+	name    string
+	modTime time.Time
+}
+
+func (info casFileInfo) Name() string {
+	return info.name
+}
+
+func (info casFileInfo) ModTime() time.Time {
+	return info.modTime
+}
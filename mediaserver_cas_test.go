@@ -0,0 +1,158 @@
+package mediaserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpload_Digest(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working)
+
+	sum := sha256.Sum256([]byte("hello world"))
+	digest := hex.EncodeToString(sum[:])
+
+	// Digests are always returned
+	result, err := ms.Upload("notes", strings.NewReader("hello world"))
+	require.Nil(t, err)
+	require.Equal(t, digest, result.Digest)
+
+	// Content-Digest headers are parsed into hex digests
+	header := "sha-512=:AAAA:, sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	parsed, err := ParseContentDigest(header)
+	require.Nil(t, err)
+	require.Equal(t, digest, parsed)
+
+	// Mismatched uploads are rejected and removed
+	_, err = ms.Upload("corrupt", strings.NewReader("hello w0rld"), WithExpectedDigest(parsed))
+	require.IsType(t, ChecksumError{}, derp.RootCause(err))
+	require.Equal(t, http.StatusBadRequest, derp.ErrorCode(err))
+
+	exists, err := afero.Exists(original, "corrupt")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// The Handler verifies Content-Digest headers
+	handler := NewHandler(ms)
+
+	request := httptest.NewRequest(http.MethodPut, "/verified", strings.NewReader("hello world"))
+	request.Header.Set("Content-Digest", header)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodPut, "/corrupt", strings.NewReader("hello w0rld"))
+	request.Header.Set("Content-Digest", header)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestUpload_ContentAddressed(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working, WithContentAddressing())
+
+	// Identical uploads share the same contents
+	first, err := ms.Upload("first", strings.NewReader("hello world"))
+	require.Nil(t, err)
+
+	second, err := ms.Upload("folder/second", strings.NewReader("hello world"))
+	require.Nil(t, err)
+	require.Equal(t, first.Digest, second.Digest)
+
+	blobPath := casBlobPath(first.Digest)
+	refs, err := afero.ReadFile(original, blobPath+".refs")
+	require.Nil(t, err)
+	require.Equal(t, "2", string(refs))
+
+	// Both filenames read the shared contents
+	for _, filename := range []string{"first", "folder/second"} {
+
+		request := httptest.NewRequest(http.MethodGet, "/"+filename, nil)
+		recorder := httptest.NewRecorder()
+		require.Nil(t, ms.ServeOriginal(recorder, request, filename))
+		require.Equal(t, "hello world", recorder.Body.String())
+
+		info, err := ms.statOriginal(filename)
+		require.Nil(t, err)
+		require.Equal(t, int64(11), info.Size())
+	}
+
+	// Contents are removed with their last reference
+	require.Nil(t, ms.Delete("first"))
+
+	exists, err := afero.Exists(original, blobPath)
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	_, err = ms.Upload("folder/second", strings.NewReader("replaced"))
+	require.Nil(t, err)
+
+	exists, err = afero.Exists(original, blobPath)
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// Failed uploads leave the existing file untouched
+	_, err = ms.Upload("folder/second", strings.NewReader("corrupt"), WithExpectedDigest(first.Digest))
+	require.NotNil(t, err)
+
+	content, err := afero.ReadFile(original, casBlobPath(hexSHA256("replaced")))
+	require.Nil(t, err)
+	require.Equal(t, "replaced", string(content))
+
+	usage, err := ms.Usage()
+	require.Nil(t, err)
+	require.Equal(t, Usage{Bytes: 8, Files: 1}, usage)
+}
+
+func TestUpload_PointerSpoofing(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working, WithContentAddressing())
+
+	secret, err := ms.Upload("secret", strings.NewReader("hello world"))
+	require.Nil(t, err)
+
+	// Uploads cannot pretend to be pointers to other files' contents
+	_, err = ms.Upload("spoof", strings.NewReader(casPointerPrefix+secret.Digest))
+	require.Equal(t, http.StatusUnprocessableEntity, derp.ErrorCode(err))
+
+	exists, err := afero.Exists(original, "spoof")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// Even when content addressing is disabled, because it may be enabled later
+	plain := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working)
+	_, err = plain.Upload("spoof", strings.NewReader(casPointerPrefix+secret.Digest))
+	require.Equal(t, http.StatusUnprocessableEntity, derp.ErrorCode(err))
+
+	// Other files of the same length are accepted
+	_, err = ms.Upload("lookalike", strings.NewReader(strings.Repeat("x", casPointerLength)))
+	require.Nil(t, err)
+}
+
+func hexSHA256(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -5,13 +5,36 @@ import "github.com/benpate/derp"
 // Delete completely removes a file from the MediaServer along with any cached files.
 func (ms MediaServer) Delete(filename string) error {
 
-	if err := ms.original.Remove(filename); err != nil {
+	if err := ms.ValidateFilename(filename); err != nil {
+		return derp.Wrap(err, "mediaserver.Delete", "Invalid filename", filename)
+	}
+
+	info, err := ms.statOriginal(filename)
+
+	if err != nil {
+		return derp.Wrap(err, "mediaserver.Delete", "Unable to find media file in 'original' filesystem", filename)
+	}
+
+	if err := ms.removeOriginalFile(filename); err != nil {
 		return derp.Wrap(err, "mediaserver.Delete", "Unable to remove media file in 'original' filesystem", filename)
 	}
 
-	if err := ms.processed.RemoveAll(filename); err != nil {
+	ms.namespaces.addUsage(ms.scopedName(filename), -info.Size(), -1)
+
+	if err := ms.removeArchive(filename); err != nil {
+		return derp.Wrap(err, "mediaserver.Delete", "Unable to remove media file in 'archive' filesystem", filename)
+	}
+
+	if err := ms.PurgeVariants(filename); err != nil {
 		return derp.Wrap(err, "mediaserver.Delete", "Unable to remove media files in 'cache' filesystem", filename)
 	}
 
+	// Remove anything that PurgeVariants leaves behind (such as files that it cannot parse)
+	if err := ms.processed.RemoveAll(filename); err != nil {
+		return derp.Wrap(err, "mediaserver.Delete", "Unable to remove media folder in 'cache' filesystem", filename)
+	}
+
+	ms.cache.forgetPrefix(ms.scopedName(filename))
+
 	return nil
 }
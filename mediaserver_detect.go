@@ -0,0 +1,88 @@
+package mediaserver
+
+import (
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/benpate/derp"
+)
+
+// DetectMimeType sniffs the first bytes of an original file and returns its mime type.
+func (ms MediaServer) DetectMimeType(filename string) (string, error) {
+
+	const location = "mediaserver.DetectMimeType"
+
+	if err := ms.ValidateFilename(filename); err != nil {
+		return "", derp.Wrap(err, location, "Invalid filename", filename)
+	}
+
+	// Open the original file
+	originalFile, err := ms.openOriginal(filename)
+
+	if err != nil {
+		return "", derp.Wrap(err, location, "Unable to open original file", filename)
+	}
+
+	defer func() {
+		if err := originalFile.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close original file", filename))
+		}
+	}()
+
+	// Read enough of the file to detect its content type
+	buffer := make([]byte, 512)
+	length, err := io.ReadFull(originalFile, buffer)
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", derp.Wrap(err, location, "Unable to read original file", filename)
+	}
+
+	return http.DetectContentType(buffer[:length]), nil
+}
+
+// DetectExtension returns a file extension (including the dot) that matches
+// the detected mime type of an original file.  This is used to fill in the
+// OriginalExtension of FileSpecs that do not already have one.
+func (ms MediaServer) DetectExtension(filename string) (string, error) {
+
+	const location = "mediaserver.DetectExtension"
+
+	mimeType, err := ms.DetectMimeType(filename)
+
+	if err != nil {
+		return "", derp.Wrap(err, location, "Unable to detect mime type", filename)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+
+	if err != nil {
+		return "", derp.Wrap(err, location, "Unable to parse mime type", filename, mimeType)
+	}
+
+	// Use the conventional extension for common types
+	if extension, ok := preferredExtensions[mediaType]; ok {
+		return extension, nil
+	}
+
+	extensions, err := mime.ExtensionsByType(mediaType)
+
+	if err != nil {
+		return "", derp.Wrap(err, location, "Unable to parse mime type", filename, mimeType)
+	}
+
+	if len(extensions) == 0 {
+		return "", nil
+	}
+
+	return extensions[0], nil
+}
+
+// preferredExtensions lists the conventional file extension for mime types that
+// have several registered extensions (mime.ExtensionsByType returns them alphabetically)
+var preferredExtensions = map[string]string{
+	"audio/mpeg": ".mp3",
+	"image/jpeg": ".jpg",
+	"text/plain": ".txt",
+	"video/mp4":  ".mp4",
+}
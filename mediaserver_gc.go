@@ -0,0 +1,74 @@
+package mediaserver
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/benpate/derp"
+)
+
+// WithCacheLimits sets the size and age limits for the processed cache.
+// Files are only evicted when GC is called (or by the background job started with StartGC).
+func WithCacheLimits(limits CacheLimits) Option {
+	return func(ms *MediaServer) {
+		ms.cache.limits = limits
+	}
+}
+
+// GC evicts processed files that exceed the cache limits, removing the files that have
+// been unused for longer than CacheLimits.MaxAge, then the least recently used files
+// until the cache is smaller than CacheLimits.MaxBytes.  Original files are never removed.
+// GC always manages the entire processed cache, even when called on a Namespace view.
+func (ms MediaServer) GC() (GCResult, error) {
+
+	const location = "mediaserver.GC"
+
+	result := GCResult{}
+
+	// Make sure we know about every file in the cache
+	if err := ms.cache.load(ms.cacheRoot); err != nil {
+		return result, derp.Wrap(err, location, "Unable to load processed cache")
+	}
+
+	for _, path := range ms.cache.candidates(time.Now()) {
+
+		size := ms.cache.size(path)
+
+		if err := ms.cacheRoot.Remove(path); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+			derp.Report(derp.Wrap(err, location, "Unable to remove processed file", path))
+			continue
+		}
+
+		ms.cache.forget(path)
+		result.Removed++
+		result.RemovedBytes += size
+	}
+
+	result.Files, result.Bytes = ms.cache.stats()
+	return result, nil
+}
+
+// StartGC runs GC in the background on the provided interval, until the context is cancelled.
+func (ms MediaServer) StartGC(ctx context.Context, interval time.Duration) {
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+				if _, err := ms.GC(); err != nil {
+					derp.Report(derp.Wrap(err, "mediaserver.StartGC", "Unable to collect garbage"))
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,207 @@
+package mediaserver
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// DefaultListLimit is the number of files that List returns when no limit is provided
+const DefaultListLimit = 1000
+
+// Original describes a single original file in the MediaServer.
+type Original struct {
+	Filename string    // Name of the original file
+	Size     int64     // Size of the original file, in bytes
+	ModTime  time.Time // Time that the original file was last uploaded
+	Version  string    // Version of the original file (see MediaServer.Version)
+	MimeType string    // Mime type sniffed from the first bytes of the file (only populated by Stat)
+	Digest   string    // SHA-256 digest of the file (hex encoded), if it is known without reading the file
+}
+
+// Stat returns information about a single original file.
+func (ms MediaServer) Stat(filename string) (Original, error) {
+
+	const location = "mediaserver.Stat"
+
+	if err := ms.ValidateFilename(filename); err != nil {
+		return Original{}, derp.Wrap(err, location, "Invalid filename", filename)
+	}
+
+	info, err := ms.statOriginal(filename)
+
+	if errors.Is(err, fs.ErrNotExist) || ((err == nil) && info.IsDir()) {
+		return Original{}, derp.NotFound(location, "Original file does not exist", filename)
+	}
+
+	if err != nil {
+		return Original{}, derp.Wrap(err, location, "Unable to stat original file", filename)
+	}
+
+	result := ms.newOriginal(filename, info)
+
+	if result.MimeType, err = ms.DetectMimeType(filename); err != nil {
+		return Original{}, derp.Wrap(err, location, "Unable to detect mime type", filename)
+	}
+
+	return result, nil
+}
+
+// List returns the original files whose names begin with the prefix, sorted by name.
+// Results are paginated: it returns up to limit files (or DefaultListLimit, if limit is
+// not positive) that sort after the cursor, along with the cursor for the next page.
+// The next cursor is empty once there are no more files.  Hidden folders (such as
+// staging areas for resumable uploads) and files with invalid names are skipped.
+// Each page only reads the folders that can contain its files, so listing large
+// stores one page at a time does not walk the whole store each time.
+func (ms MediaServer) List(prefix string, cursor string, limit int) ([]Original, string, error) {
+
+	const location = "mediaserver.List"
+
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	// Every matching file is inside the folder named by the prefix, so start there
+	folder := ""
+
+	if index := strings.LastIndex(prefix, "/"); index >= 0 {
+		folder = prefix[:index]
+	}
+
+	// Collect one extra filename, to know if there is another page
+	filenames, err := ms.listFolder(folder, prefix, cursor, limit+1, make([]string, 0, limit+1))
+
+	if err != nil {
+		return nil, "", derp.Wrap(err, location, "Unable to list original filesystem", prefix)
+	}
+
+	nextCursor := ""
+
+	if len(filenames) > limit {
+		filenames = filenames[:limit]
+		nextCursor = filenames[limit-1]
+	}
+
+	result := make([]Original, 0, len(filenames))
+
+	for _, filename := range filenames {
+
+		info, err := ms.statOriginal(filename)
+
+		// Files may be removed while they are being listed
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, "", derp.Wrap(err, location, "Unable to stat original file", filename)
+		}
+
+		result = append(result, ms.newOriginal(filename, info))
+	}
+
+	return result, nextCursor, nil
+}
+
+// listFolder appends the names of files in a folder (and its subfolders) that begin with the
+// prefix and sort after the cursor, in lexical order, until there are count filenames.
+// Subfolders that cannot contain any of these files are never read.
+func (ms MediaServer) listFolder(folder string, prefix string, cursor string, count int, filenames []string) ([]string, error) {
+
+	entries, err := afero.ReadDir(ms.original, folder)
+
+	// New Namespaces (and prefixes that do not match any folder) have nothing to list
+	if errors.Is(err, fs.ErrNotExist) {
+		return filenames, nil
+	}
+
+	if err != nil {
+		return filenames, err
+	}
+
+	// Sort folders by their name plus a slash, so that files are visited in lexical order
+	// (for example, "a-1" sorts before "a/1")
+	slices.SortFunc(entries, func(a fs.FileInfo, b fs.FileInfo) int {
+		return strings.Compare(listKey(a), listKey(b))
+	})
+
+	for _, entry := range entries {
+
+		if len(filenames) >= count {
+			return filenames, nil
+		}
+
+		filename := path.Join(folder, entry.Name())
+
+		if entry.IsDir() {
+
+			// Skip hidden folders, folders that cannot contain the prefix,
+			// and folders whose files all sort before the cursor
+			key := filename + "/"
+
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+
+			if (key < cursor) && !strings.HasPrefix(cursor, key) {
+				continue
+			}
+
+			if filenames, err = ms.listFolder(filename, prefix, cursor, count, filenames); err != nil {
+				return filenames, err
+			}
+
+			continue
+		}
+
+		if !strings.HasPrefix(filename, prefix) || (filename <= cursor) {
+			continue
+		}
+
+		if ms.ValidateFilename(filename) != nil {
+			continue
+		}
+
+		filenames = append(filenames, filename)
+	}
+
+	return filenames, nil
+}
+
+// listKey returns the name that a folder entry sorts by in List
+func listKey(info fs.FileInfo) string {
+
+	if info.IsDir() {
+		return info.Name() + "/"
+	}
+
+	return info.Name()
+}
+
+// newOriginal describes an original file, using information that is available without reading it
+func (ms MediaServer) newOriginal(filename string, info fs.FileInfo) Original {
+
+	result := Original{
+		Filename: filename,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Version:  fileVersion(info),
+	}
+
+	if digest, ok := ms.readPointer(filename); ok {
+		result.Digest = digest
+	}
+
+	return result
+}
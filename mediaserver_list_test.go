@@ -0,0 +1,110 @@
+package mediaserver
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStat(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working, WithContentAddressing())
+
+	result, err := ms.Upload("notes", strings.NewReader("hello world"))
+	require.Nil(t, err)
+
+	original, err := ms.Stat("notes")
+	require.Nil(t, err)
+	require.Equal(t, "notes", original.Filename)
+	require.Equal(t, int64(11), original.Size)
+	require.Equal(t, result.Version, original.Version)
+	require.Equal(t, result.Digest, original.Digest)
+	require.Equal(t, "text/plain; charset=utf-8", original.MimeType)
+
+	_, err = ms.Stat("missing")
+	require.Equal(t, http.StatusNotFound, derp.ErrorCode(err))
+
+	_, err = ms.Stat("../notes")
+	require.Equal(t, http.StatusBadRequest, derp.ErrorCode(err))
+}
+
+func TestList(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working)
+
+	for _, filename := range []string{"b", "a-1", "a/2", "a/1", "c/d/e"} {
+		require.Nil(t, ms.Put(filename, strings.NewReader(filename)))
+	}
+
+	// Hidden folders and invalid filenames are skipped
+	require.Nil(t, afero.WriteFile(original, ".uploads/staged", []byte("staged"), 0666))
+	require.Nil(t, afero.WriteFile(original, "bad name", []byte("bad"), 0666))
+
+	filenames := func(originals []Original) []string {
+		result := make([]string, 0, len(originals))
+		for _, original := range originals {
+			result = append(result, original.Filename)
+		}
+		return result
+	}
+
+	// Files are sorted by name, and paginated with a cursor
+	page, cursor, err := ms.List("", "", 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a-1", "a/1"}, filenames(page))
+	require.Equal(t, "a/1", cursor)
+
+	page, cursor, err = ms.List("", cursor, 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a/2", "b"}, filenames(page))
+
+	page, cursor, err = ms.List("", cursor, 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"c/d/e"}, filenames(page))
+	require.Equal(t, "", cursor)
+
+	// Prefixes match partial names and folders
+	page, _, err = ms.List("a/", "", 0)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a/1", "a/2"}, filenames(page))
+
+	page, _, err = ms.List("c/d", "", 0)
+	require.Nil(t, err)
+	require.Equal(t, []string{"c/d/e"}, filenames(page))
+
+	page, _, err = ms.List("missing/", "", 0)
+	require.Nil(t, err)
+	require.Empty(t, page)
+
+	// Cursors can point inside folders
+	page, cursor, err = ms.List("", "a/1", 1)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a/2"}, filenames(page))
+	require.Equal(t, "a/2", cursor)
+
+	// Namespaces only list their own files
+	namespace, err := ms.Namespace("tenant")
+	require.Nil(t, err)
+
+	page, _, err = namespace.List("", "", 0)
+	require.Nil(t, err)
+	require.Empty(t, page)
+
+	require.Nil(t, namespace.Put("photo", strings.NewReader("photo")))
+
+	page, _, err = namespace.List("", "", 0)
+	require.Nil(t, err)
+	require.Equal(t, []string{"photo"}, filenames(page))
+}
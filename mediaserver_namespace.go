@@ -0,0 +1,247 @@
+package mediaserver
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// WithDefaultQuota sets the Quota for every Namespace that does not have its own Quota.
+func WithDefaultQuota(quota Quota) Option {
+	return func(ms *MediaServer) {
+		ms.namespaces.defaultQuota = quota
+	}
+}
+
+// WithQuota sets the Quota for a single Namespace
+func WithQuota(namespace string, quota Quota) Option {
+	return func(ms *MediaServer) {
+		ms.namespaces.setQuota(namespace, quota)
+	}
+}
+
+// Namespace returns a view of the MediaServer whose original, processed, and working files
+// are all stored under the namespace prefix, so that many tenants can share one MediaServer
+// without colliding.  Filenames passed to (and returned by) the view do not include the prefix.
+// Puts through the view are limited by the Namespace's Quota (see WithQuota and WithDefaultQuota).
+// Namespaces can be nested, and all views share the MediaServer's presets, workers, and cache.
+func (ms MediaServer) Namespace(name string) (MediaServer, error) {
+
+	if err := ms.ValidateFilename(name); err != nil {
+		return ms, derp.Wrap(err, "mediaserver.Namespace", "Invalid namespace name", name)
+	}
+
+	ms.namespace = ms.scopedName(name)
+	ms.original = afero.NewBasePathFs(ms.original, name)
+	ms.processed = afero.NewBasePathFs(ms.processed, name)
+	return ms, nil
+}
+
+// NamespaceName returns the full prefix of this Namespace view, or an empty string
+// if this is not a Namespace view.
+func (ms MediaServer) NamespaceName() string {
+	return ms.namespace
+}
+
+// Quota returns the Quota that applies to this Namespace view.
+// The MediaServer itself (outside of any Namespace) is never limited.
+func (ms MediaServer) Quota() Quota {
+
+	if ms.namespace == "" {
+		return Quota{}
+	}
+
+	return ms.namespaces.quota(ms.namespace)
+}
+
+// Usage returns the total size and number of original files in this Namespace view.
+// Usage is calculated from the original filesystem the first time that it is needed,
+// then tracked as files are added and removed through the view.
+func (ms MediaServer) Usage() (Usage, error) {
+
+	const location = "mediaserver.Usage"
+
+	if usage, ok := ms.namespaces.getUsage(ms.namespace); ok && (ms.namespace != "") {
+		return usage, nil
+	}
+
+	usage := Usage{}
+
+	err := afero.Walk(ms.original, "", func(path string, info fs.FileInfo, err error) error {
+
+		// New Namespaces do not have a folder yet
+		if (path == "") && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden directories (such as content-addressed storage)
+		if info.IsDir() {
+			if (path != "") && strings.HasPrefix(info.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// Content-addressed files count the full size of their contents
+		if ms.contentAddressed {
+			if info, err = ms.statOriginal(path); err != nil {
+				return err
+			}
+		}
+
+		usage.Bytes += info.Size()
+		usage.Files++
+		return nil
+	})
+
+	if err != nil {
+		return usage, derp.Wrap(err, location, "Unable to walk original filesystem", ms.namespace)
+	}
+
+	// The MediaServer itself includes every Namespace, so its usage is never tracked
+	if ms.namespace == "" {
+		return usage, nil
+	}
+
+	return ms.namespaces.loadUsage(ms.namespace, usage), nil
+}
+
+// reserveQuota returns a QuotaError if a new original file cannot be added to this Namespace view.
+// replacedSize is the size of the original file that is being replaced (if any).  The returned
+// reservation holds a place for the new file (and its bytes, as they are read) so that concurrent
+// uploads cannot exceed the Quota together.  It is nil if the Namespace has no Quota.
+func (ms MediaServer) reserveQuota(replaced bool, replacedSize int64) (*quotaReservation, error) {
+
+	const location = "mediaserver.reserveQuota"
+
+	quota := ms.Quota()
+
+	if (quota.MaxBytes == 0) && (quota.MaxFiles == 0) {
+		return nil, nil
+	}
+
+	// Load the Namespace's usage before reserving anything against it
+	if _, err := ms.Usage(); err != nil {
+		return nil, derp.Wrap(err, location, "Unable to calculate usage", ms.namespace)
+	}
+
+	reservation := quotaReservation{
+		registry:  ms.namespaces,
+		namespace: ms.namespace,
+		quota:     quota,
+		credit:    replacedSize,
+	}
+
+	// New files (but not replacements) count against the file quota
+	if !replaced {
+
+		usage, ok := ms.namespaces.reserve(ms.namespace, quota, 0, 1)
+
+		if !ok {
+			return nil, QuotaError{Namespace: ms.namespace, Quota: quota, Usage: usage, Reason: "too many files"}
+		}
+
+		reservation.files = 1
+	}
+
+	// Reject uploads into Namespaces that are already full
+	if usage := ms.namespaces.reservedUsage(ms.namespace); (quota.MaxBytes > 0) && (usage.Bytes-replacedSize >= quota.MaxBytes) {
+		reservation.release()
+		return nil, QuotaError{Namespace: ms.namespace, Quota: quota, Usage: usage, Reason: "too many bytes"}
+	}
+
+	return &reservation, nil
+}
+
+// quotaReservation holds a place in a Namespace's Quota for an upload that is still in progress.
+// Every method is safe to call on a nil reservation (when there is no Quota).
+type quotaReservation struct {
+	registry  *namespaceRegistry
+	namespace string
+	quota     Quota
+	credit    int64 // Size of the file that is being replaced, which is freed once the upload succeeds
+	bytes     int64 // Number of bytes that are currently reserved
+	files     int   // Number of files that are currently reserved
+	read      int64 // Number of bytes that have been read from the upload
+}
+
+// limit returns a reader that reserves bytes as they are read, and fails with
+// a QuotaError as soon as the Quota would be exceeded.
+func (reservation *quotaReservation) limit(file io.Reader) io.Reader {
+
+	if reservation == nil {
+		return file
+	}
+
+	return quotaReader{reader: file, reservation: reservation}
+}
+
+// grow reserves enough bytes for an upload of the given size
+func (reservation *quotaReservation) grow(size int64) error {
+
+	// Replacements only reserve the bytes beyond the size of the file that they replace
+	needed := max(size-reservation.credit, 0) - reservation.bytes
+
+	if needed <= 0 {
+		return nil
+	}
+
+	usage, ok := reservation.registry.reserve(reservation.namespace, reservation.quota, needed, 0)
+
+	if !ok {
+		return QuotaError{Namespace: reservation.namespace, Quota: reservation.quota, Usage: usage, Reason: "too many bytes"}
+	}
+
+	reservation.bytes += needed
+	return nil
+}
+
+// release returns everything that is reserved.  Successful uploads release their
+// reservation after the new file has been added to the Namespace's usage.
+func (reservation *quotaReservation) release() {
+
+	if reservation == nil {
+		return
+	}
+
+	reservation.registry.release(reservation.namespace, reservation.bytes, reservation.files)
+	reservation.bytes = 0
+	reservation.files = 0
+}
+
+// quotaReader reserves bytes in a quotaReservation as they are read
+type quotaReader struct {
+	reader      io.Reader
+	reservation *quotaReservation
+}
+
+func (reader quotaReader) Read(buffer []byte) (int, error) {
+
+	length, err := reader.reader.Read(buffer)
+	reader.reservation.read += int64(length)
+
+	if reserveErr := reader.reservation.grow(reader.reservation.read); reserveErr != nil {
+		return length, reserveErr
+	}
+
+	return length, err
+}
+
+// scopedName returns the full name (including the namespace prefix) of a name within this view.
+// It is used for keys that are shared by every view, such as working files and cache entries.
+func (ms MediaServer) scopedName(name string) string {
+
+	if ms.namespace == "" {
+		return name
+	}
+
+	return ms.namespace + "/" + name
+}
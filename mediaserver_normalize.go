@@ -0,0 +1,473 @@
+package mediaserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/mediaserver/ffmpeg"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+)
+
+// Normalization describes how uploaded images are rewritten before they are stored as originals.
+// Only still images are normalized.  Animated GIFs, audio, video, and other files are stored as uploaded.
+// Normalized images are always re-encoded, which applies their EXIF orientation so that they are
+// stored upright.  Expected digests (see WithExpectedDigest) are checked against the upload as it
+// was received, while PutResult.Digest reports the digest of the normalized file.
+type Normalization struct {
+	Extension     string   // Canonical format for originals (".jpg", ".png", or ".webp").  Defaults to the uploaded format, or ".jpg" if it cannot be written
+	MaxWidth      int      // Largest width (in pixels) of an original.  Wider images are scaled down.  Zero is unlimited
+	MaxHeight     int      // Largest height (in pixels) of an original.  Taller images are scaled down.  Zero is unlimited
+	StripMetadata []string // Metadata keys to remove (such as LocationMetadata), or "*" to remove all metadata
+	Archive       afero.Fs // If set, the untouched upload is also kept in this filesystem, under the same filename.  Only used by WithNormalization
+}
+
+// LocationMetadata lists the metadata keys that FFmpeg uses for GPS locations.  Use it with
+// Normalization.StripMetadata to remove locations while keeping other metadata.
+var LocationMetadata = []string{"location", "location-eng", "com.apple.quicktime.location.ISO6709"}
+
+// WithNormalization normalizes every uploaded image before it is stored.  Individual Puts
+// can override this with WithUploadNormalization.
+func WithNormalization(normalization Normalization) Option {
+	return func(ms *MediaServer) {
+		ms.normalization = normalization
+	}
+}
+
+// WithUploadNormalization normalizes this upload (if it is an image) before it is stored.
+// Use an empty Normalization to store the upload exactly as it was received.  Its Archive is
+// ignored: untouched uploads are always kept in the MediaServer's archive (see WithNormalization),
+// so that Delete can find them again.
+func WithUploadNormalization(normalization Normalization) PutOption {
+	return func(config *putConfig) {
+		normalization.Archive = config.normalization.Archive
+		config.normalization = normalization
+	}
+}
+
+// enabled returns TRUE if the Normalization changes uploads at all
+func (normalization Normalization) enabled() bool {
+	return (normalization.Extension != "") ||
+		(normalization.MaxWidth > 0) ||
+		(normalization.MaxHeight > 0) ||
+		(len(normalization.StripMetadata) > 0)
+}
+
+// outputExtension returns the extension to write a normalized image of this mime type to
+func (normalization Normalization) outputExtension(mimeType string) string {
+
+	if normalization.Extension != "" {
+		return "." + strings.TrimPrefix(normalization.Extension, ".")
+	}
+
+	switch mimeType {
+
+	case "image/png":
+		return ".png"
+
+	case "image/webp":
+		return ".webp"
+	}
+
+	return ".jpg"
+}
+
+// ffmpegArguments returns the FFmpeg arguments that normalize an image.
+// Orientation is the EXIF orientation of the input (or zero if it is not known).
+func (normalization Normalization) ffmpegArguments(input string, output string, orientation int) []string {
+
+	args := make([]string, 0)
+
+	// EXIF orientations are applied by the filters below.  Otherwise, FFmpeg applies
+	// any orientation that it understands (such as HEIF rotations) automatically.
+	if orientation > 1 {
+		args = append(args, "-noautorotate")
+	}
+
+	args = append(args, "-i", input)
+
+	filters := orientationFilters(orientation)
+
+	if (normalization.MaxWidth > 0) || (normalization.MaxHeight > 0) {
+		width := "iw"
+		height := "ih"
+
+		if normalization.MaxWidth > 0 {
+			width = "min(" + strconv.Itoa(normalization.MaxWidth) + ",iw)"
+		}
+
+		if normalization.MaxHeight > 0 {
+			height = "min(" + strconv.Itoa(normalization.MaxHeight) + ",ih)"
+		}
+
+		filters = append(filters, "scale='"+width+"':'"+height+"':force_original_aspect_ratio=decrease")
+	}
+
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ", "))
+	}
+
+	for _, key := range normalization.StripMetadata {
+
+		if key == "*" {
+			args = append(args, "-map_metadata", "-1")
+			continue
+		}
+
+		args = append(args, "-metadata", key+"=")
+	}
+
+	// Reuse the codecs that are used for processed images
+	filespec := FileSpec{Extension: path.Ext(output)}
+	args = append(args, filespec.ffmpegArguments()...)
+	args = append(args, "-frames:v", "1", "-y", output)
+
+	return args
+}
+
+// normalizedUpload is an upload that has been written to a temporary file (and re-encoded, if it is an image)
+type normalizedUpload struct {
+	*os.File
+	input      string // Temporary file containing the upload as it was received
+	output     string // Temporary file containing the normalized image (if any)
+	normalized bool   // TRUE if the upload was re-encoded
+}
+
+// normalize writes an upload to a temporary file and (if it is a still image) re-encodes it with FFmpeg.
+// It verifies any expected digest against the upload as it was received.  The caller must close the result.
+func (ms MediaServer) normalize(filename string, file io.Reader, config *putConfig) (*normalizedUpload, error) {
+
+	const location = "mediaserver.normalize"
+
+	result := &normalizedUpload{}
+
+	// Write the upload into a temporary file, because FFmpeg needs to seek through it
+	tempFile, err := os.CreateTemp("", "mediaserver-*")
+
+	if err != nil {
+		return nil, derp.Wrap(err, location, "Unable to create temporary file", filename)
+	}
+
+	result.input = tempFile.Name()
+
+	hash := sha256.New()
+	_, err = io.Copy(tempFile, io.TeeReader(file, hash))
+
+	if closeErr := tempFile.Close(); (err == nil) && (closeErr != nil) {
+		err = closeErr
+	}
+
+	if err != nil {
+		result.close()
+		return nil, derp.Wrap(err, location, "Unable to write temporary file", filename)
+	}
+
+	// Verify the upload as it was received, because normalization changes its digest
+	if digest := hex.EncodeToString(hash.Sum(nil)); (config.digest != "") && (config.digest != digest) {
+		result.close()
+		return nil, derp.Wrap(ChecksumError{Filename: filename, Expected: config.digest, Actual: digest}, location, "Upload does not match the expected digest", filename)
+	}
+
+	config.digest = ""
+
+	// Scan the upload as it was received, before FFmpeg reads it (or it is archived)
+	if err := ms.scanLocalFile(filename, result.input); err != nil {
+		result.close()
+		return nil, derp.Wrap(err, location, "Upload was not accepted by the scanner", filename)
+	}
+
+	// Read the beginning of the file to detect its type and orientation
+	head, err := readHead(result.input, 64*1024)
+
+	if err != nil {
+		result.close()
+		return nil, derp.Wrap(err, location, "Unable to read temporary file", filename)
+	}
+
+	mimeType := sniffStillImage(head)
+
+	// Files that are not still images are stored as uploaded
+	if mimeType == "" {
+
+		if result.File, err = os.Open(result.input); err != nil {
+			result.close()
+			return nil, derp.Wrap(err, location, "Unable to open temporary file", filename)
+		}
+
+		return result, nil
+	}
+
+	if !ffmpeg.IsInstalled {
+		result.close()
+		return nil, derp.InternalError(location, "FFmpeg is not installed on this server")
+	}
+
+	// Re-encode the image with FFmpeg
+	result.output = getTempFilename(config.normalization.outputExtension(mimeType))
+	args := config.normalization.ffmpegArguments(result.input, result.output, exifOrientation(head))
+
+	log.Trace().Str("location", location).Msg("Executing: ffmpeg " + strings.Join(args, " "))
+
+	var errors bytes.Buffer
+
+	command := exec.Command("ffmpeg", args...)
+	command.Stderr = &errors
+
+	if err := command.Run(); err != nil {
+		result.close()
+		return nil, derp.Wrap(UploadError{Filename: filename, Code: http.StatusUnprocessableEntity, Reason: "image cannot be normalized"}, location, "Unable to run FFmpeg", filename, errors.String(), err.Error())
+	}
+
+	if result.File, err = os.Open(result.output); err != nil {
+		result.close()
+		return nil, derp.Wrap(err, location, "Unable to open normalized file", filename)
+	}
+
+	result.normalized = true
+	return result, nil
+}
+
+// stageArchive copies the upload (as it was received) into a staging file in the archive
+// filesystem, if it was normalized.  It returns the staging path, or "" if nothing was archived.
+func (upload *normalizedUpload) stageArchive(archive afero.Fs) (string, error) {
+
+	const location = "mediaserver.normalizedUpload.stageArchive"
+
+	if (archive == nil) || !upload.normalized {
+		return "", nil
+	}
+
+	stagingPath, err := newStagingPath()
+
+	if err != nil {
+		return "", derp.Wrap(err, location, "Unable to create staging filename")
+	}
+
+	if err := ensureAferoFolderExists(archive, stagingFolder); err != nil {
+		return "", derp.Wrap(err, location, "Unable to create staging folder in 'archive' filesystem")
+	}
+
+	input, err := os.Open(upload.input)
+
+	if err != nil {
+		return "", derp.Wrap(err, location, "Unable to open temporary file", upload.input)
+	}
+
+	defer func() {
+		if err := input.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close temporary file", upload.input))
+		}
+	}()
+
+	if err := afero.WriteReader(archive, stagingPath, input); err != nil {
+		_ = archive.Remove(stagingPath)
+		return "", derp.Wrap(err, location, "Unable to write file in 'archive' filesystem", stagingPath)
+	}
+
+	return stagingPath, nil
+}
+
+// close removes the temporary files of a normalized upload
+func (upload *normalizedUpload) close() {
+
+	const location = "mediaserver.normalizedUpload.close"
+
+	if upload.File != nil {
+		if err := upload.File.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close temporary file", upload.File.Name()))
+		}
+	}
+
+	for _, filename := range []string{upload.input, upload.output} {
+		if filename != "" {
+			if err := os.Remove(filename); (err != nil) && !os.IsNotExist(err) {
+				derp.Report(derp.Wrap(err, location, "Unable to remove temporary file", filename))
+			}
+		}
+	}
+}
+
+// removeArchive removes the archived copy of an original file (if any)
+func (ms MediaServer) removeArchive(filename string) error {
+
+	if ms.normalization.Archive == nil {
+		return nil
+	}
+
+	if err := ms.normalization.Archive.Remove(ms.scopedName(filename)); (err != nil) && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// readHead returns (up to) the first bytes of a local file
+func readHead(filename string, size int) ([]byte, error) {
+
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	buffer := make([]byte, size)
+	length, err := io.ReadFull(file, buffer)
+
+	if (err != nil) && (err != io.EOF) && (err != io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+
+	return buffer[:length], nil
+}
+
+// sniffStillImage returns the mime type of a still image, or an empty string if the
+// file is not a still image.  GIFs are not normalized, because they may be animated.
+func sniffStillImage(head []byte) string {
+
+	// HEIF images (from phones) are not detected by http.DetectContentType
+	if (len(head) >= 12) && (string(head[4:8]) == "ftyp") {
+		switch string(head[8:12]) {
+		case "heic", "heix", "heim", "heis", "mif1", "msf1":
+			return "image/heic"
+		case "avif":
+			return "image/avif"
+		}
+	}
+
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+
+	if strings.HasPrefix(mimeType, "image/") && (mimeType != "image/gif") {
+		return mimeType
+	}
+
+	return ""
+}
+
+// exifOrientation returns the EXIF orientation (1-8) of a JPEG image,
+// or zero if the image does not include one.
+func exifOrientation(head []byte) int {
+
+	if !bytes.HasPrefix(head, []byte{0xFF, 0xD8}) {
+		return 0
+	}
+
+	// Walk through the JPEG segments until the EXIF segment is found
+	for offset := 2; offset+4 <= len(head); {
+
+		if head[offset] != 0xFF {
+			return 0
+		}
+
+		marker := head[offset+1]
+		length := int(binary.BigEndian.Uint16(head[offset+2:]))
+
+		// Start of scan means that there is no more metadata
+		if (marker == 0xDA) || (length < 2) {
+			return 0
+		}
+
+		segment := head[offset+4 : min(offset+2+length, len(head))]
+
+		if (marker == 0xE1) && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+
+		offset += 2 + length
+	}
+
+	return 0
+}
+
+// tiffOrientation returns the orientation tag from the first IFD of a TIFF header (used by EXIF)
+func tiffOrientation(tiff []byte) int {
+
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	// Check the offset before converting it, because it can overflow an int on 32-bit platforms
+	offset := order.Uint32(tiff[4:])
+
+	if offset > uint32(len(tiff)-2) {
+		return 0
+	}
+
+	ifd := int(offset)
+
+	count := int(order.Uint16(tiff[ifd:]))
+
+	for index := 0; index < count; index++ {
+
+		entry := ifd + 2 + (index * 12)
+
+		if entry+12 > len(tiff) {
+			return 0
+		}
+
+		// Tag 0x0112 is the orientation, stored as a SHORT
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+
+			if orientation := int(order.Uint16(tiff[entry+8:])); (orientation >= 1) && (orientation <= 8) {
+				return orientation
+			}
+
+			return 0
+		}
+	}
+
+	return 0
+}
+
+// orientationFilters returns the FFmpeg filters that turn an image with this EXIF orientation upright
+func orientationFilters(orientation int) []string {
+
+	switch orientation {
+
+	case 2:
+		return []string{"hflip"}
+
+	case 3:
+		return []string{"hflip", "vflip"}
+
+	case 4:
+		return []string{"vflip"}
+
+	case 5:
+		return []string{"transpose=0"}
+
+	case 6:
+		return []string{"transpose=1"}
+
+	case 7:
+		return []string{"transpose=3"}
+
+	case 8:
+		return []string{"transpose=2"}
+	}
+
+	return []string{}
+}
@@ -0,0 +1,142 @@
+package mediaserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/mediaserver/ffmpeg"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalization_PassThrough(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	archive := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working, WithNormalization(Normalization{MaxWidth: 100, Archive: archive}))
+
+	// Files that are not still images are stored exactly as uploaded, and are not archived
+	result, err := ms.Upload("notes", strings.NewReader("hello world"), WithExpectedDigest(hexSHA256("hello world")))
+	require.Nil(t, err)
+	require.Equal(t, hexSHA256("hello world"), result.Digest)
+
+	content, err := afero.ReadFile(original, "notes")
+	require.Nil(t, err)
+	require.Equal(t, "hello world", string(content))
+
+	exists, err := afero.Exists(archive, "notes")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// Expected digests are checked against the upload as it was received
+	_, err = ms.Upload("corrupt", strings.NewReader("hello w0rld"), WithExpectedDigest(hexSHA256("hello world")))
+	require.IsType(t, ChecksumError{}, derp.RootCause(err))
+}
+
+func TestNormalization_Image(t *testing.T) {
+
+	if !ffmpeg.IsInstalled {
+		t.Skip("FFmpeg is not installed")
+	}
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	archive := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working, WithNormalization(Normalization{MaxWidth: 20, StripMetadata: []string{"*"}, Archive: archive}))
+
+	var upload bytes.Buffer
+	require.Nil(t, png.Encode(&upload, image.NewRGBA(image.Rect(0, 0, 80, 40))))
+
+	_, err := ms.Upload("photo", bytes.NewReader(upload.Bytes()))
+	require.Nil(t, err)
+
+	// The original is scaled down, keeping its aspect ratio
+	file, err := original.Open("photo")
+	require.Nil(t, err)
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	require.Nil(t, err)
+	require.Equal(t, 20, config.Width)
+	require.Equal(t, 10, config.Height)
+
+	// The untouched upload is archived, and removed along with the original
+	content, err := afero.ReadFile(archive, "photo")
+	require.Nil(t, err)
+	require.Equal(t, upload.Bytes(), content)
+
+	require.Nil(t, ms.Delete("photo"))
+
+	exists, err := afero.Exists(archive, "photo")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestNormalization_Arguments(t *testing.T) {
+
+	normalization := Normalization{MaxWidth: 2048, StripMetadata: LocationMetadata}
+	args := strings.Join(normalization.ffmpegArguments("in.jpg", "out.webp", 6), " ")
+
+	require.Equal(t, "-noautorotate -i in.jpg -vf transpose=1, scale='min(2048,iw)':'ih':force_original_aspect_ratio=decrease "+
+		"-metadata location= -metadata location-eng= -metadata com.apple.quicktime.location.ISO6709= -c:v webp -frames:v 1 -y out.webp", args)
+
+	// Unrotated images are left to FFmpeg, and all metadata can be removed
+	normalization = Normalization{StripMetadata: []string{"*"}}
+	args = strings.Join(normalization.ffmpegArguments("in.heic", "out.jpg", 0), " ")
+	require.Equal(t, "-i in.heic -map_metadata -1 -c:v mjpeg -frames:v 1 -y out.jpg", args)
+
+	require.Equal(t, ".jpg", normalization.outputExtension("image/heic"))
+	require.Equal(t, ".png", normalization.outputExtension("image/png"))
+	require.Equal(t, ".webp", Normalization{Extension: "webp"}.outputExtension("image/png"))
+}
+
+func TestExifOrientation(t *testing.T) {
+
+	// jpeg builds a JPEG header with an EXIF segment containing a single orientation tag
+	jpeg := func(order binary.AppendByteOrder, marker string, orientation uint16) []byte {
+
+		tiff := []byte(marker)
+		tiff = order.AppendUint16(tiff, 42)
+		tiff = order.AppendUint32(tiff, 8)
+		tiff = order.AppendUint16(tiff, 1)           // one IFD entry
+		tiff = order.AppendUint16(tiff, 0x0112)      // orientation tag
+		tiff = order.AppendUint16(tiff, 3)           // SHORT
+		tiff = order.AppendUint32(tiff, 1)           // count
+		tiff = order.AppendUint16(tiff, orientation) // value
+		tiff = append(tiff, 0, 0, 0, 0, 0, 0)        // padding, and next IFD offset
+
+		segment := append([]byte("Exif\x00\x00"), tiff...)
+
+		result := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00} // SOI, and an empty APP0
+		result = append(result, 0xFF, 0xE1)
+		result = binary.BigEndian.AppendUint16(result, uint16(len(segment)+2))
+		return append(result, segment...)
+	}
+
+	require.Equal(t, 6, exifOrientation(jpeg(binary.LittleEndian, "II", 6)))
+	require.Equal(t, 8, exifOrientation(jpeg(binary.BigEndian, "MM", 8)))
+	require.Equal(t, 0, exifOrientation(jpeg(binary.BigEndian, "MM", 9)))
+	require.Equal(t, 0, exifOrientation([]byte("\x89PNG\r\n\x1a\n")))
+
+	// IFD offsets past the end of the header (including ones that overflow a 32-bit int) are ignored
+	for _, offset := range []uint32{13, 0x7FFFFFFF, 0xFFFFFFFF} {
+		tiff := binary.LittleEndian.AppendUint32([]byte("II\x2a\x00"), offset)
+		require.Equal(t, 0, tiffOrientation(append(tiff, 0, 0, 0, 0, 0, 0)), offset)
+	}
+
+	// Still images are detected, including HEIF images from phones
+	require.Equal(t, "image/jpeg", sniffStillImage(jpeg(binary.BigEndian, "MM", 1)))
+	require.Equal(t, "image/heic", sniffStillImage([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00")))
+	require.Equal(t, "", sniffStillImage([]byte("GIF89a")))
+}
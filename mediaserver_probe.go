@@ -0,0 +1,96 @@
+package mediaserver
+
+import (
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/mediaserver/ffmpeg"
+)
+
+// Probe inspects an original file with ffprobe and returns the format and streams that it contains.
+func (ms MediaServer) Probe(filename string) (ffmpeg.ProbeResult, error) {
+
+	const location = "mediaserver.Probe"
+
+	if err := ms.ValidateFilename(filename); err != nil {
+		return ffmpeg.ProbeResult{}, derp.Wrap(err, location, "Invalid filename", filename)
+	}
+
+	// Confirm that FFprobe is installed
+	if !ffmpeg.ProbeIsInstalled {
+		return ffmpeg.ProbeResult{}, derp.Internal(location, "FFprobe is not installed on this server")
+	}
+
+	// Open the original file from the afero filesystem
+	originalFile, err := ms.openOriginal(filename)
+
+	if err != nil {
+		return ffmpeg.ProbeResult{}, derp.Wrap(err, location, "Unable to open original file", filename)
+	}
+
+	defer func() {
+		if err := originalFile.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close original file", filename))
+		}
+	}()
+
+	result, err := probeFile(originalFile)
+
+	if err != nil {
+		return result, derp.Wrap(err, location, "Unable to probe file", filename)
+	}
+
+	return result, nil
+}
+
+// probeStaged inspects a staged upload (in the original filesystem) with ffprobe
+func (ms MediaServer) probeStaged(stagingPath string) (ffmpeg.ProbeResult, error) {
+
+	const location = "mediaserver.probeStaged"
+
+	if !ffmpeg.ProbeIsInstalled {
+		return ffmpeg.ProbeResult{}, derp.Internal(location, "FFprobe is not installed on this server")
+	}
+
+	staged, err := ms.original.Open(stagingPath)
+
+	if err != nil {
+		return ffmpeg.ProbeResult{}, derp.Wrap(err, location, "Unable to open staging file", stagingPath)
+	}
+
+	defer func() {
+		if err := staged.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close staging file", stagingPath))
+		}
+	}()
+
+	return probeFile(staged)
+}
+
+// probeFile copies a file into the temp directory (because ffprobe needs a real file) and probes it
+func probeFile(file io.Reader) (ffmpeg.ProbeResult, error) {
+
+	const location = "mediaserver.probeFile"
+
+	tempFilename, err := writeTempFile(file, "")
+
+	if err != nil {
+		return ffmpeg.ProbeResult{}, derp.Wrap(err, location, "Unable to write temp file")
+	}
+
+	defer func() {
+		if err := os.Remove(tempFilename); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to remove temp file", tempFilename))
+		}
+	}()
+
+	result, err := ffmpeg.Probe(tempFilename)
+
+	if err != nil {
+		return result, derp.Wrap(err, location, "Unable to probe file", derp.WithCode(http.StatusUnprocessableEntity))
+	}
+
+	return result, nil
+}
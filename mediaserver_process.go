@@ -18,8 +18,12 @@ func (ms MediaServer) Process(filespec FileSpec, output io.Writer) error {
 
 	const location = "mediaserver.Process"
 
+	if err := ms.validateFileSpec(filespec); err != nil {
+		return derp.Wrap(err, location, "Invalid filename", filespec)
+	}
+
 	// Open the original file from the afero filesystem
-	originalFile, err := ms.original.Open(filespec.Filename)
+	originalFile, err := ms.openOriginal(filespec.Filename)
 
 	if err != nil {
 		return derp.Wrap(err, location, "Unable to open original file", filespec)
@@ -178,36 +182,77 @@ func (ms *MediaServer) ensureProcessedFileExists(filespec FileSpec) error {
 
 	// If the processed file already exists, then there's nothing more to do.
 	if exists, _ := afero.Exists(ms.processed, filespec.ProcessedPath()); exists {
+		ms.cache.touch(ms.scopedName(filespec.ProcessedPath()))
 		return nil
 	}
 
+	// Wait for a worker (if the worker pool is limited) before touching the cache
+	if ms.workers != nil {
+		ms.workers <- struct{}{}
+		defer func() { <-ms.workers }()
+
+		// Another request may have created the processed file while this one was waiting
+		if exists, _ := afero.Exists(ms.processed, filespec.ProcessedPath()); exists {
+			ms.cache.touch(ms.scopedName(filespec.ProcessedPath()))
+			return nil
+		}
+	}
+
 	log.Trace().Str("location", location).Str("processedPath", filespec.ProcessedPath()).Msg("Processed file does not exist.  Creating...")
 
-	// Guarantee that a folder exists to put the processed file into
-	if err := ensureAferoFolderExists(ms.processed, filespec.ProcessedDir()); err != nil {
-		return derp.Wrap(err, location, "Unable to create cache folder", filespec)
+	// Process the file into a staging file, and only rename it into the cache once it is complete,
+	// so that other requests never see (or serve) a partial file.
+	stagingPath, err := newStagingPath()
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to create staging filename", filespec)
+	}
+
+	defer ms.removeStaged(ms.processed, stagingPath)
+
+	if err := ensureAferoFolderExists(ms.processed, stagingFolder); err != nil {
+		return derp.Wrap(err, location, "Unable to create staging folder", filespec)
 	}
 
-	// Create a new processed file and write the processed file into the cache
-	// TODO: This should probably write to a temp file until the process is complete, then rename it.
-	cachedFile, err := ms.processed.Create(filespec.ProcessedPath())
+	stagedFile, err := ms.processed.Create(stagingPath)
 
 	if err != nil {
 		return derp.Wrap(err, location, "Unable to create file in mediaserver cache", filespec)
 	}
 
-	defer func() {
-		if err := cachedFile.Close(); err != nil {
-			derp.Report(derp.Wrap(err, location, "Unable to close cached file", filespec))
-		}
-	}()
+	writer := &countingWriter{writer: stagedFile}
+	err = ms.Process(filespec, writer)
 
-	// Process the file into the cache.  Write it fully, before returning it to the caller.
-	if err := ms.Process(filespec, cachedFile); err != nil {
-		derp.Report(ms.processed.Remove(cachedFile.Name()))
+	if closeErr := stagedFile.Close(); (err == nil) && (closeErr != nil) {
+		err = closeErr
+	}
+
+	if err != nil {
 		return derp.Wrap(err, location, "Unable to process original file", filespec)
 	}
 
+	if err := promoteStaged(ms.processed, stagingPath, filespec.ProcessedPath()); err != nil {
+		return derp.Wrap(err, location, "Unable to move processed file into mediaserver cache", filespec)
+	}
+
+	// Track the new file so that it can be evicted later
+	ms.cache.record(ms.scopedName(filespec.ProcessedPath()), writer.count)
+
 	// Great success.
 	return nil
 }
+
+// Generate makes sure that the processed variant described by the FileSpec exists in the cache,
+// processing the original file if necessary.
+func (ms MediaServer) Generate(filespec FileSpec) error {
+
+	if err := ms.validateFileSpec(filespec); err != nil {
+		return derp.Wrap(err, "mediaserver.Generate", "Invalid filename", filespec)
+	}
+
+	if err := ms.ensureProcessedFileExists(filespec); err != nil {
+		return derp.Wrap(err, "mediaserver.Generate", "Unable to generate processed file", filespec)
+	}
+
+	return nil
+}
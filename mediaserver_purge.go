@@ -0,0 +1,131 @@
+package mediaserver
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// PurgeVariants removes every processed variant of a file (from both the processed
+// cache and the working directory) without removing the original file.
+func (ms MediaServer) PurgeVariants(filename string) error {
+
+	if err := ms.PurgeVariantsFunc(filename, func(FileSpec) bool { return true }); err != nil {
+		return derp.Wrap(err, "mediaserver.PurgeVariants", "Unable to purge variants", filename)
+	}
+
+	return nil
+}
+
+// PurgeVariantsFunc removes the processed variants of a file that match the predicate
+// (from both the processed cache and the working directory) without removing the original file.
+func (ms MediaServer) PurgeVariantsFunc(filename string, predicate func(FileSpec) bool) error {
+
+	const location = "mediaserver.PurgeVariantsFunc"
+
+	if err := ms.ValidateFilename(filename); err != nil {
+		return derp.Wrap(err, location, "Invalid filename", filename)
+	}
+
+	// Remove matching files from the processed cache
+	entries, err := afero.ReadDir(ms.processed, filename)
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return derp.Wrap(err, location, "Unable to read processed directory", filename)
+	}
+
+	remaining := 0
+
+	for _, entry := range entries {
+
+		if entry.IsDir() {
+			remaining++
+			continue
+		}
+
+		filespec, ok := parseProcessedFilename(filename, entry.Name())
+
+		if !ok || !predicate(filespec) {
+			remaining++
+			continue
+		}
+
+		processedPath := path.Join(filename, entry.Name())
+
+		if err := ms.processed.Remove(processedPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return derp.Wrap(err, location, "Unable to remove processed file", processedPath)
+		}
+
+		ms.cache.forget(ms.scopedName(processedPath))
+	}
+
+	// Remove the (now empty) processed directory
+	if (len(entries) > 0) && (remaining == 0) {
+		if err := ms.processed.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return derp.Wrap(err, location, "Unable to remove processed directory", filename)
+		}
+	}
+
+	// Remove matching files from the working directory
+	ms.working.RemoveFunc(func(name string) bool {
+		filespec, ok := parseWorkingFilename(ms.scopedName(filename), name)
+		filespec.Filename = filename
+		return ok && predicate(filespec)
+	})
+
+	return nil
+}
+
+// PurgeStaleVariants removes every processed file that was created by an older processing
+// pipeline (a different PipelineRevision or different FFmpeg arguments), including files
+// that were cached before pipeline versions were added to cache keys.  Stale files are
+// never served, so this only reclaims space.  It returns the number of files removed.
+func (ms MediaServer) PurgeStaleVariants() (int, error) {
+
+	const location = "mediaserver.PurgeStaleVariants"
+
+	stale := make([]string, 0)
+
+	err := afero.Walk(ms.processed, "", func(filePath string, info fs.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden directories (such as staging areas for uploads and processed files), which are not part of the cache
+		if info.IsDir() {
+			if (filePath != "") && strings.HasPrefix(info.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		filePath = strings.TrimPrefix(filePath, "/")
+		filespec, ok := parseProcessedFilename(path.Dir(filePath), path.Base(filePath))
+
+		if ok && (filespec.pipeline != filespec.pipelineVersion()) {
+			stale = append(stale, filePath)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, derp.Wrap(err, location, "Unable to walk processed filesystem")
+	}
+
+	for _, filePath := range stale {
+
+		if err := ms.processed.Remove(filePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, derp.Wrap(err, location, "Unable to remove stale processed file", filePath)
+		}
+
+		ms.cache.forget(ms.scopedName(filePath))
+	}
+
+	return len(stale), nil
+}
@@ -1,40 +1,697 @@
 package mediaserver
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/benpate/derp"
+	"github.com/spf13/afero"
 )
 
+// PutResult reports the outcome of an upload
+type PutResult struct {
+	Filename string          // Name of the original file that was saved
+	Digest   string          // SHA-256 digest of the uploaded contents (hex encoded)
+	Version  string          // Version of the original file that was saved (see MediaServer.Version)
+	Replaced bool            // TRUE if this upload replaced an existing original file
+	Variants []VariantResult // Results for each variant that was generated synchronously
+}
+
+// VariantResult reports the outcome of generating a single processed variant
+type VariantResult struct {
+	FileSpec FileSpec // The variant that was generated
+	Error    error    // Error generating the variant, or nil if successful
+}
+
+// PutOption modifies the behavior of a single Put
+type PutOption func(*putConfig)
+
+// putConfig collects all of the PutOptions for a single Put
+type putConfig struct {
+	variants      []FileSpec
+	presets       []string
+	background    bool
+	onVariant     func(VariantResult)
+	limits        UploadLimits
+	digest        string
+	createOnly    bool
+	ifMatch       []string
+	normalization Normalization
+}
+
+// UploadLimits describes the uploads that Put will accept.  Zero values are unlimited.
+type UploadLimits struct {
+	MaxBytes  int64    // Largest upload, in bytes
+	MimeTypes []string // Allowed mime types (such as "image/jpeg" or "image/*"), sniffed from the first bytes of the upload
+	Probe     bool     // If TRUE, then uploads that ffprobe cannot decode are rejected
+}
+
+// WithUploadLimits sets the default UploadLimits for every Put.  Individual Puts can
+// override these limits with WithMaxUploadBytes, WithAllowedMimeTypes, and WithProbe.
+func WithUploadLimits(limits UploadLimits) Option {
+	return func(ms *MediaServer) {
+		ms.uploadLimits = limits
+	}
+}
+
+// WithMaxUploadBytes rejects uploads that are larger than this number of bytes
+func WithMaxUploadBytes(maxBytes int64) PutOption {
+	return func(config *putConfig) {
+		config.limits.MaxBytes = maxBytes
+	}
+}
+
+// WithAllowedMimeTypes rejects uploads whose mime type (sniffed from the first bytes
+// of the upload) does not match one of these values.  Values may end in "/*" to allow
+// every subtype, such as "image/*".
+func WithAllowedMimeTypes(mimeTypes ...string) PutOption {
+	return func(config *putConfig) {
+		config.limits.MimeTypes = mimeTypes
+	}
+}
+
+// WithExpectedDigest rejects uploads whose SHA-256 digest (hex encoded) does not match.
+// Use ParseContentDigest to read the digest from a Content-Digest header.
+func WithExpectedDigest(digest string) PutOption {
+	return func(config *putConfig) {
+		config.digest = strings.ToLower(digest)
+	}
+}
+
+// ParseContentDigest reads the SHA-256 digest (hex encoded) from a Content-Digest header
+// (RFC 9530), such as "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:".  Other
+// algorithms are ignored, so it returns an empty string if the header has no SHA-256 digest.
+func ParseContentDigest(header string) (string, error) {
+
+	const location = "mediaserver.ParseContentDigest"
+
+	for _, member := range strings.Split(header, ",") {
+
+		algorithm, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+
+		if strings.ToLower(algorithm) != "sha-256" {
+			continue
+		}
+
+		encoded, ok := strings.CutPrefix(value, ":")
+		encoded, ok2 := strings.CutSuffix(encoded, ":")
+
+		if !ok || !ok2 {
+			return "", derp.BadRequest(location, "Digest must be a byte sequence", member)
+		}
+
+		digest, err := base64.StdEncoding.DecodeString(encoded)
+
+		if (err != nil) || (len(digest) != sha256.Size) {
+			return "", derp.BadRequest(location, "Digest is not a valid SHA-256 digest", member)
+		}
+
+		return hex.EncodeToString(digest), nil
+	}
+
+	return "", nil
+}
+
+// WithCreateOnly rejects uploads (with a ConflictError) if the original file already exists.
+// Uploads to the same filename are serialized, so this is safe between Puts to the same MediaServer.
+// Content-addressed uploads also use exclusive creates, which are safe between separate processes.
+func WithCreateOnly() PutOption {
+	return func(config *putConfig) {
+		config.createOnly = true
+	}
+}
+
+// WithIfMatch rejects uploads (with a ConflictError) unless the original file already exists
+// and matches one of the provided values.  Values may be the file's SHA-256 digest (hex encoded),
+// its ETag (see MediaServer.ETag), or "*" to match any existing file.  ETags are weak, so
+// matching one is best-effort; only the digest guarantees that the file has not changed.
+func WithIfMatch(values ...string) PutOption {
+	return func(config *putConfig) {
+		config.ifMatch = append(config.ifMatch, values...)
+	}
+}
+
+// WithProbe rejects uploads that ffprobe cannot decode
+func WithProbe() PutOption {
+	return func(config *putConfig) {
+		config.limits.Probe = true
+	}
+}
+
+// WithVariants generates processed variants as soon as the original file has been saved.
+// The Filename of each FileSpec is replaced with the uploaded filename, and the
+// OriginalExtension is detected from the file contents if it is empty.
+func WithVariants(variants ...FileSpec) PutOption {
+	return func(config *putConfig) {
+		config.variants = append(config.variants, variants...)
+	}
+}
+
+// WithPresetVariants generates processed variants for each of the named Presets
+// as soon as the original file has been saved.
+func WithPresetVariants(presetNames ...string) PutOption {
+	return func(config *putConfig) {
+		config.presets = append(config.presets, presetNames...)
+	}
+}
+
+// WithBackgroundVariants generates variants in a background goroutine, so that Put
+// returns as soon as the original file has been saved.  The callback (if not nil) is
+// called once for each variant.  Errors are also reported via derp.Report.
+// Use MediaServer.Wait to let background variants finish before shutting down.
+func WithBackgroundVariants(callback func(VariantResult)) PutOption {
+	return func(config *putConfig) {
+		config.background = true
+		config.onVariant = callback
+	}
+}
+
+// Wait blocks until every variant that is being generated in the background
+// (see WithBackgroundVariants) is finished.  Call it before shutting down, so that
+// background goroutines do not outlive the filesystems and WorkingDirectory they use.
+func (ms MediaServer) Wait() {
+	ms.background.Wait()
+}
+
 // Put adds a new file into the MediaServer.
-func (ms MediaServer) Put(filename string, file io.Reader) error {
+func (ms MediaServer) Put(filename string, file io.Reader, options ...PutOption) error {
+
+	if _, err := ms.Upload(filename, file, options...); err != nil {
+		return derp.Wrap(err, "mediaserver.Put", "Unable to put file", filename)
+	}
+
+	return nil
+}
+
+// Upload adds a new file into the MediaServer, applying all of the provided PutOptions,
+// and returns a detailed report of the results.  Uploads that are rejected by the
+// UploadLimits return an UploadError.  Uploads are staged until every check has passed,
+// so rejected (or interrupted) uploads never change the existing original or its variants.
+func (ms MediaServer) Upload(filename string, file io.Reader, options ...PutOption) (PutResult, error) {
+
+	const location = "mediaserver.Upload"
+
+	config := putConfig{
+		limits:        ms.uploadLimits,
+		normalization: ms.normalization,
+	}
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	result := PutResult{
+		Filename: filename,
+	}
+
+	if err := ms.ValidateFilename(filename); err != nil {
+		return result, derp.Wrap(err, location, "Invalid filename", filename)
+	}
+
+	// Resolve all variants before touching the filesystem, so that bad presets fail early
+	variants, err := ms.resolveVariants(filename, config)
+
+	if err != nil {
+		return result, derp.Wrap(err, location, "Unable to resolve variants", filename)
+	}
+
+	// Uploads to the same filename happen one at a time, so that conditions are checked safely
+	unlock := ms.uploadLocks.lock(ms.scopedName(filename))
+	defer unlock()
+
+	// Remember if this upload replaces an existing file, so that stale variants can be purged
+	var replacedSize int64
+
+	if info, err := ms.statOriginal(filename); err == nil {
+		result.Replaced = true
+		replacedSize = info.Size()
+	}
+
+	// Reject uploads whose conditions do not match the existing file
+	if err := ms.checkConditions(filename, config, result.Replaced); err != nil {
+		return result, derp.Wrap(err, location, "Upload conditions do not match", filename)
+	}
+
+	// Reject uploads that are not an allowed type, before touching the filesystem
+	file, err = config.limits.checkMimeType(filename, file)
+
+	if err != nil {
+		return result, derp.Wrap(err, location, "Upload is not an allowed type", filename)
+	}
+
+	// Reject uploads that are too large while they are being written
+	file = config.limits.limitSize(filename, file)
+
+	// Rewrite images into their canonical form (if requested)
+	var normalized *normalizedUpload
+
+	if config.normalization.enabled() {
+
+		normalized, err = ms.normalize(filename, file, &config)
+
+		if err != nil {
+			return result, derp.Wrap(err, location, "Unable to normalize upload", filename)
+		}
+
+		defer normalized.close()
+		file = normalized
+	}
+
+	// Reject uploads that would exceed the Namespace's Quota
+	reservation, err := ms.reserveQuota(result.Replaced, replacedSize)
+
+	if err != nil {
+		return result, derp.Wrap(err, location, "Upload would exceed quota", filename)
+	}
+
+	defer reservation.release()
+	file = reservation.limit(file)
+
+	// Every upload is written to a hidden staging file first, and only replaces the original
+	// once every check has passed.  Failed uploads leave the existing original (and its variants) untouched.
+	stagingPath, err := newStagingPath()
+
+	if err != nil {
+		return result, derp.Wrap(err, location, "Unable to create staging filename", filename)
+	}
+
+	defer ms.removeStaged(ms.original, stagingPath)
+
+	if err := ensureAferoFolderExists(ms.original, stagingFolder); err != nil {
+		return result, derp.Wrap(err, location, "Unable to create staging folder in 'original' filesystem", filename)
+	}
+
+	staged, err := ms.original.Create(stagingPath)
+
+	if err != nil {
+		return result, derp.Wrap(err, location, "Unable to create staging file in 'original' filesystem", filename)
+	}
+
+	// Save the upload into the staging file, calculating its digest (and scanning it) along the way
+	hash := sha256.New()
+	writers := []io.Writer{staged, hash}
+
+	var scan *scanJob
+
+	if ms.scanner != nil {
+		scan = startScan(ms.scanner)
+		writers = append(writers, scan)
+	}
+
+	size, err := io.Copy(io.MultiWriter(writers...), file)
+
+	if err != nil {
+
+		scan.abort(err)
+
+		if closeErr := staged.Close(); closeErr != nil {
+			derp.Report(derp.Wrap(closeErr, location, "Unable to close staging file on err.", filename))
+		}
+
+		return result, derp.Wrap(err, location, "Unable to write media file in 'original' filesystem", filename)
+	}
+
+	// Wait for the Scanner's verdict (if there is a Scanner)
+	verdict, scanErr := scan.wait()
+
+	if err := staged.Close(); err != nil {
+		return result, derp.Wrap(err, location, "Unable to close staging file", filename)
+	}
+
+	result.Digest = hex.EncodeToString(hash.Sum(nil))
+
+	// Reject uploads that were corrupted along the way
+	if (config.digest != "") && (config.digest != result.Digest) {
+		return result, derp.Wrap(ChecksumError{Filename: filename, Expected: config.digest, Actual: result.Digest}, location, "Upload does not match the expected digest", filename)
+	}
+
+	// Reject uploads that would be mistaken for content-addressed pointers (and read other files' contents)
+	if size == int64(casPointerLength) {
+		if content, err := afero.ReadFile(ms.original, stagingPath); err != nil {
+			return result, derp.Wrap(err, location, "Unable to read staging file", filename)
+		} else if _, ok := parsePointer(content); ok {
+			return result, derp.Wrap(UploadError{Filename: filename, Code: http.StatusUnprocessableEntity, Reason: "content is reserved"}, location, "Upload matches the content-addressed pointer format", filename)
+		}
+	}
+
+	// Reject (and quarantine) uploads that the Scanner does not accept
+	if scanErr != nil {
+		return result, derp.Wrap(scanErr, location, "Unable to scan upload", filename)
+	}
+
+	if verdict.Infected {
+
+		if err := ms.quarantineStaged(filename, stagingPath); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to quarantine infected upload", filename))
+		}
+
+		return result, derp.Wrap(InfectedError{Filename: filename, Signature: verdict.Signature}, location, "Upload is infected", filename)
+	}
+
+	// Reject uploads that cannot be decoded
+	if config.limits.Probe {
+		if _, err := ms.probeStaged(stagingPath); err != nil {
+			return result, derp.Wrap(UploadError{Filename: filename, Code: http.StatusUnprocessableEntity, Reason: "media cannot be decoded"}, location, "Upload cannot be decoded", filename, err.Error())
+		}
+	}
+
+	// Stage the untouched upload in the archive (if requested)
+	archivePath := ""
+
+	if normalized != nil {
+
+		if archivePath, err = normalized.stageArchive(config.normalization.Archive); err != nil {
+			return result, derp.Wrap(err, location, "Unable to archive upload", filename)
+		}
+
+		if archivePath != "" {
+			defer ms.removeStaged(config.normalization.Archive, archivePath)
+		}
+	}
+
+	// NOTE: This process used to write directly to the final destination, because renames
+	// are not atomic on S3.  But failed uploads destroyed the files that they were replacing.
+	// Now, the only non-atomic step is the rename itself, after every check has passed.
 
-	const location = "mediaserver.Put"
+	// Move the staged upload over the original
+	if ms.contentAddressed {
+
+		// Point the filename at its (deduplicated) contents
+		if err := ms.storeContentAddressed(filename, stagingPath, result.Digest, config.createOnly); err != nil {
+			return result, derp.Wrap(err, location, "Unable to store content-addressed file", filename)
+		}
 
-	// Open the destination (in afero)
-	destination, err := ms.original.Create(filename)
+	} else {
+
+		// Uploads to the same filename are serialized above, so this check is not racing other Puts
+		if config.createOnly {
+			if exists, _ := afero.Exists(ms.original, filename); exists {
+				return result, derp.Wrap(ConflictError{Filename: filename, Reason: "file already exists"}, location, "Original file already exists", filename)
+			}
+		}
+
+		if err := promoteStaged(ms.original, stagingPath, filename); err != nil {
+			return result, derp.Wrap(err, location, "Unable to move upload into 'original' filesystem", filename)
+		}
+	}
+
+	// Keep the untouched upload (if requested).  The original is already stored, so failures are only reported.
+	if archivePath != "" {
+		if err := promoteStaged(config.normalization.Archive, archivePath, ms.scopedName(filename)); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to move upload into 'archive' filesystem", filename))
+		}
+	}
+
+	// Track the new file in the usage of every Namespace that contains it, then release its reservation
+	if result.Replaced {
+		ms.namespaces.addUsage(ms.scopedName(filename), size-replacedSize, 0)
+	} else {
+		ms.namespaces.addUsage(ms.scopedName(filename), size, 1)
+	}
+
+	reservation.release()
+
+	// Remove variants of the file that was replaced.  The new original is already stored, and
+	// versioned cache keys keep stale variants from being served, so failures are only reported.
+	if result.Replaced {
+		if err := ms.PurgeVariants(filename); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to purge variants of replaced file", filename))
+		}
+	}
+
+	// Report the new version to the caller
+	if version, err := ms.Version(filename); err == nil {
+		result.Version = version
+	}
+
+	// Generate variants (if requested)
+	if len(variants) > 0 {
+
+		if config.background {
+			ms.background.Add(1)
+			go func() {
+				defer ms.background.Done()
+				ms.generateVariants(variants, config.onVariant)
+			}()
+		} else {
+			result.Variants = ms.generateVariants(variants, nil)
+		}
+	}
+
+	return result, nil
+}
+
+// checkConditions returns a ConflictError if the create-only or if-match conditions of an
+// upload do not match the existing original file.
+func (ms MediaServer) checkConditions(filename string, config putConfig, exists bool) error {
+
+	if config.createOnly && exists {
+		return ConflictError{Filename: filename, Reason: "file already exists"}
+	}
+
+	if len(config.ifMatch) == 0 {
+		return nil
+	}
+
+	if !exists {
+		return ConflictError{Filename: filename, Reason: "file does not exist"}
+	}
+
+	etag, err := ms.ETag(filename)
 
 	if err != nil {
-		return derp.Wrap(err, location, "Unable to create media file in 'original' filesystem", filename)
+		return derp.Wrap(err, "mediaserver.checkConditions", "Unable to calculate ETag", filename)
+	}
+
+	digest := ""
+
+	for _, value := range config.ifMatch {
+
+		value = strings.TrimSpace(value)
+
+		if (value == "*") || (opaqueTag(value) == opaqueTag(etag)) {
+			return nil
+		}
+
+		if value = strings.ToLower(value); !isSHA256(value) {
+			continue
+		}
+
+		// Only calculate the digest of the existing file if it is needed
+		if digest == "" {
+			if digest, err = ms.originalDigest(filename); err != nil {
+				return derp.Wrap(err, "mediaserver.checkConditions", "Unable to calculate digest", filename)
+			}
+		}
+
+		if value == digest {
+			return nil
+		}
 	}
 
-	// Save the upload into the destination
-	if _, err = io.Copy(destination, file); err != nil {
+	return ConflictError{Filename: filename, Reason: "file does not match"}
+}
+
+// originalDigest returns the SHA-256 digest (hex encoded) of an original file
+func (ms MediaServer) originalDigest(filename string) (string, error) {
+
+	const location = "mediaserver.originalDigest"
+
+	// Content-addressed files already know their digest
+	if digest, ok := ms.readPointer(filename); ok {
+		return digest, nil
+	}
 
-		if closeErr := destination.Close(); closeErr != nil {
-			return derp.Wrap(err, location, "Unable to close destination file on err.", closeErr)
+	file, err := ms.openOriginal(filename)
+
+	if err != nil {
+		return "", derp.Wrap(err, location, "Unable to open original file", filename)
+	}
+
+	defer func() {
+		if err := file.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close original file", filename))
 		}
+	}()
 
-		return derp.Wrap(err, location, "Unable to write media file in 'original' filesystem", filename)
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", derp.Wrap(err, location, "Unable to read original file", filename)
 	}
 
-	// NOTE: This process used to upload to a temporary file first, then rename it
-	// to the final destination.  This caused problems with S3, because the rename
-	// operation is not atomic.
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkMimeType sniffs the first bytes of an upload and returns an UploadError if its
+// mime type is not allowed.  The returned reader still includes the sniffed bytes.
+func (limits UploadLimits) checkMimeType(filename string, file io.Reader) (io.Reader, error) {
 
-	// Finish the transaction.
-	if err := destination.Close(); err != nil {
-		return derp.Wrap(err, location, "Unable to close destination file", filename)
+	if len(limits.MimeTypes) == 0 {
+		return file, nil
 	}
+
+	buffer := make([]byte, 512)
+	length, err := io.ReadFull(file, buffer)
+
+	if (err != nil) && (err != io.EOF) && (err != io.ErrUnexpectedEOF) {
+		return nil, derp.Wrap(err, "mediaserver.UploadLimits.checkMimeType", "Unable to read upload", filename)
+	}
+
+	buffer = buffer[:length]
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(buffer))
+
+	if matchesMimeType(mimeType, limits.MimeTypes) {
+		return io.MultiReader(bytes.NewReader(buffer), file), nil
+	}
+
+	return nil, UploadError{Filename: filename, Code: http.StatusUnsupportedMediaType, Reason: "mime type " + mimeType + " is not allowed"}
+}
+
+// matchesMimeType returns TRUE if the mime type matches one of the allowed values.
+// Allowed values may end in "/*" to match every subtype, such as "image/*".
+func matchesMimeType(mimeType string, allowed []string) bool {
+
+	for _, value := range allowed {
+
+		if prefix, ok := strings.CutSuffix(value, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+			continue
+		}
+
+		if mimeType == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// limitSize returns a reader that fails with an UploadError once the upload exceeds MaxBytes
+func (limits UploadLimits) limitSize(filename string, file io.Reader) io.Reader {
+
+	if limits.MaxBytes <= 0 {
+		return file
+	}
+
+	return &limitReader{
+		reader:    file,
+		remaining: limits.MaxBytes,
+		err:       UploadError{Filename: filename, Code: http.StatusRequestEntityTooLarge, Reason: "upload is larger than " + strconv.FormatInt(limits.MaxBytes, 10) + " bytes"},
+	}
+}
+
+// stagingFolder is the (hidden) folder where uploads are written until every check has passed
+const stagingFolder = ".staging"
+
+// newStagingPath returns a new, unique location for an upload that has not been checked yet
+func newStagingPath() (string, error) {
+
+	buffer := make([]byte, 16)
+
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	return path.Join(stagingFolder, "tmp-"+hex.EncodeToString(buffer)), nil
+}
+
+// promoteStaged moves a staging file into its final location, replacing any existing file
+func promoteStaged(filesystem afero.Fs, stagingPath string, filename string) error {
+
+	if folder := path.Dir(filename); folder != "." {
+		if err := ensureAferoFolderExists(filesystem, folder); err != nil {
+			return derp.Wrap(err, "mediaserver.promoteStaged", "Unable to create folder", filename)
+		}
+	}
+
+	if err := filesystem.Rename(stagingPath, filename); err != nil {
+		return derp.Wrap(err, "mediaserver.promoteStaged", "Unable to rename staging file", stagingPath, filename)
+	}
+
 	return nil
 }
+
+// removeStaged removes a staging file (if it still exists).  Errors are reported, not returned.
+func (ms MediaServer) removeStaged(filesystem afero.Fs, stagingPath string) {
+
+	if err := filesystem.Remove(stagingPath); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+		derp.Report(derp.Wrap(err, "mediaserver.removeStaged", "Unable to remove staging file", stagingPath))
+	}
+}
+
+// resolveVariants collects all of the FileSpecs and Presets requested in a putConfig
+func (ms MediaServer) resolveVariants(filename string, config putConfig) ([]FileSpec, error) {
+
+	result := make([]FileSpec, 0, len(config.variants)+len(config.presets))
+
+	for _, variant := range config.variants {
+		variant.Filename = filename
+		result = append(result, variant)
+	}
+
+	for _, presetName := range config.presets {
+
+		variant, err := ms.PresetFileSpec(filename, presetName)
+
+		if err != nil {
+			return nil, derp.Wrap(err, "mediaserver.resolveVariants", "Unable to load preset", presetName)
+		}
+
+		result = append(result, variant)
+	}
+
+	return result, nil
+}
+
+// generateVariants writes each variant into the processed cache, reporting the results
+// to the (optional) callback and returning them to the caller.
+func (ms MediaServer) generateVariants(variants []FileSpec, callback func(VariantResult)) []VariantResult {
+
+	const location = "mediaserver.generateVariants"
+
+	result := make([]VariantResult, 0, len(variants))
+	originalExtensions := make(map[string]string)
+
+	for _, variant := range variants {
+
+		// Detect the original file type (once per file) if it was not provided
+		if variant.OriginalExtension == "" {
+
+			if extension, ok := originalExtensions[variant.Filename]; ok {
+				variant.OriginalExtension = extension
+			} else if extension, err := ms.DetectExtension(variant.Filename); err == nil {
+				originalExtensions[variant.Filename] = extension
+				variant.OriginalExtension = extension
+			}
+		}
+
+		variantResult := VariantResult{FileSpec: variant}
+
+		if err := ms.Generate(variant); err != nil {
+			variantResult.Error = derp.Wrap(err, location, "Unable to generate variant", variant)
+			derp.Report(variantResult.Error)
+		}
+
+		if callback != nil {
+			callback(variantResult)
+		}
+
+		result = append(result, variantResult)
+	}
+
+	return result
+}
@@ -5,20 +5,60 @@ import (
 	"net/http"
 
 	"github.com/benpate/derp"
+	"github.com/spf13/afero"
 )
 
 // Serve locates the file, processes it if necessary, and returns it to the caller.
 // If the filespec.Cache is set to FALSE, then file will be processed and returned.
 // If the filespec.Cache is set to TRUE, then the processed file will retrieved
 // from the cache (if possible) and the processed file will be stored in the cache.
+// If the MediaServer has a Signer, then the request URL must include a valid signature for the filespec.
 func (ms MediaServer) Serve(responseWriter http.ResponseWriter, request *http.Request, filespec FileSpec) error {
 
 	const location = "mediaserver.Serve"
 
-	workingFilename := filespec.WorkingFilename()
+	// Reject unsafe filenames before touching any filesystem
+	if err := ms.validateFileSpec(filespec); err != nil {
+		return derp.Wrap(err, location, "Invalid filename", filespec)
+	}
+
+	// Reject unsigned or tampered requests before doing any work
+	if ms.signer != nil {
+		if !ms.signer.allowPresets || !ms.presets.match(filespec) {
+			if err := ms.signer.Verify(filespec, request.URL.Query()); err != nil {
+				return derp.Wrap(err, location, "Request signature is not valid", filespec)
+			}
+		}
+	}
+
+	// Reject requests that are not allowed by the Policy
+	if err := ms.Validate(filespec); err != nil {
+		return derp.Wrap(err, location, "FileSpec is not allowed", filespec)
+	}
+
+	// Versioned requests always use the current version, so that arbitrary
+	// version strings cannot create new cache entries
+	if filespec.Version != "" {
+
+		version, err := ms.Version(filespec.Filename)
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to get current version", filespec)
+		}
+
+		filespec.Version = version
+	}
+
+	workingFilename := ms.scopedName(filespec.WorkingFilename())
 
 	// Guarantee that we have a working file to serve
 	if err := ms.esureWorkingFileExists(filespec); err != nil {
+
+		// If the working directory is full, then serve the processed file directly
+		if derp.ErrorCode(err) == http.StatusInsufficientStorage {
+			return ms.serveProcessed(responseWriter, request, filespec)
+		}
+
 		return derp.Wrap(err, location, "Unable to ensure working file exists", filespec)
 	}
 
@@ -35,6 +75,32 @@ func (ms MediaServer) Serve(responseWriter http.ResponseWriter, request *http.Re
 		}
 	}()
 
+	return serveContent(responseWriter, request, filespec, workingFile)
+}
+
+// serveProcessed serves a file directly from the processed filesystem, bypassing the working directory.
+func (ms MediaServer) serveProcessed(responseWriter http.ResponseWriter, request *http.Request, filespec FileSpec) error {
+
+	const location = "mediaserver.serveProcessed"
+
+	processedFile, err := ms.processed.Open(filespec.ProcessedPath())
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to open processed file", filespec)
+	}
+
+	defer func() {
+		if err := processedFile.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close processed file", filespec))
+		}
+	}()
+
+	return serveContent(responseWriter, request, filespec, processedFile)
+}
+
+// serveContent writes a (working or processed) file to the HTTP response
+func serveContent(responseWriter http.ResponseWriter, request *http.Request, filespec FileSpec, file afero.File) error {
+
 	// Populate header values
 	header := responseWriter.Header()
 	header.Set("ETag", "IMMUTABLE")
@@ -43,14 +109,14 @@ func (ms MediaServer) Serve(responseWriter http.ResponseWriter, request *http.Re
 		header.Set("Cache-Control", "public, max-age=86400, immutable") // Store in public caches for 1 day
 	}
 
-	// Serve the working file
-	workingFileInfo, err := workingFile.Stat()
+	// Serve the file
+	fileInfo, err := file.Stat()
 
 	if err != nil {
-		return derp.Wrap(err, location, "Unable to get stats for working file", workingFilename)
+		return derp.Wrap(err, "mediaserver.serveContent", "Unable to get stats for file", filespec)
 	}
 
-	http.ServeContent(responseWriter, request, filespec.DownloadFilename(), workingFileInfo.ModTime(), workingFile)
+	http.ServeContent(responseWriter, request, filespec.DownloadFilename(), fileInfo.ModTime(), file)
 
 	// Content (should be) served.
 	return nil
@@ -61,8 +127,12 @@ func (ms MediaServer) ServeOriginal(responseWriter http.ResponseWriter, request
 
 	const location = "mediaserver.Serve"
 
+	if err := ms.ValidateFilename(filename); err != nil {
+		return derp.Wrap(err, location, "Invalid filename", filename)
+	}
+
 	// Load the original file
-	originalFile, err := ms.original.Open(filename)
+	originalFile, err := ms.openOriginal(filename)
 
 	if err != nil {
 		return derp.Wrap(err, location, "Unable to open working file", filename)
@@ -74,7 +144,11 @@ func (ms MediaServer) ServeOriginal(responseWriter http.ResponseWriter, request
 		}
 	}()
 
-	// Write the HTTP response
+	// Write the HTTP response, including an ETag that can be used for conditional uploads
+	if etag, err := ms.ETag(filename); err == nil {
+		responseWriter.Header().Set("ETag", etag)
+	}
+
 	responseWriter.Header().Set("Content-Type", "application/octet-stream")
 	responseWriter.WriteHeader(http.StatusOK)
 
@@ -91,10 +165,11 @@ func (ms MediaServer) esureWorkingFileExists(filespec FileSpec) error {
 
 	const location = "mediaserver.ensureWorkingFile"
 
-	workingFilename := filespec.WorkingFilename()
+	workingFilename := ms.scopedName(filespec.WorkingFilename())
 
 	// If the working file already exists, then there's nothing more to do.
 	if ms.working.Exists(workingFilename) {
+		ms.cache.touch(ms.scopedName(filespec.ProcessedPath()))
 		return nil
 	}
 
@@ -110,6 +185,23 @@ func (ms MediaServer) esureWorkingFileExists(filespec FileSpec) error {
 		return derp.Wrap(err, location, "Unable to open processed file", filespec)
 	}
 
+	defer func() {
+		if err := processedFile.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close processed file", filespec))
+		}
+	}()
+
+	// Files that are too large for the working directory are served directly, without copying them first
+	info, err := processedFile.Stat()
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to stat processed file", filespec)
+	}
+
+	if !ms.working.Fits(info.Size()) {
+		return derp.Internal(location, "Processed file is too large for the working directory", filespec, info.Size(), derp.WithCode(http.StatusInsufficientStorage))
+	}
+
 	// Copy the (probably remote) processed file to a (definitely local) working file
 	if err := ms.working.Write(workingFilename, processedFile); err != nil {
 		return derp.Wrap(err, location, "Unable to copy working file", filespec)
@@ -1,10 +1,18 @@
 package mediaserver
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/benpate/derp"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 )
@@ -19,3 +27,472 @@ func TestMediaServer(t *testing.T) {
 
 	require.NotNil(t, m)
 }
+
+func TestUpload_Variants(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	processed := afero.NewMemMapFs()
+	m := New(afero.NewMemMapFs(), processed, &working, WithWorkers(2))
+
+	result, err := m.Upload("notes", strings.NewReader("hello world"), WithVariants(FileSpec{Extension: ".txt"}))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(result.Variants))
+	require.Nil(t, result.Variants[0].Error)
+	require.Equal(t, ".txt", result.Variants[0].FileSpec.OriginalExtension)
+
+	exists, err := afero.Exists(processed, result.Variants[0].FileSpec.ProcessedPath())
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	// Background variants are finished once Wait returns
+	var background []VariantResult
+
+	result, err = m.Upload("other", strings.NewReader("hello world"), WithVariants(FileSpec{Extension: ".txt"}), WithBackgroundVariants(func(variant VariantResult) {
+		background = append(background, variant)
+	}))
+	require.Nil(t, err)
+	require.Empty(t, result.Variants)
+
+	m.Wait()
+	require.Equal(t, 1, len(background))
+	require.Nil(t, background[0].Error)
+
+	exists, err = afero.Exists(processed, "other/cached.txt")
+	require.Nil(t, err)
+	require.True(t, exists)
+}
+
+func TestWarm(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	m := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working, WithWorkers(2))
+
+	for _, filename := range []string{"a", "b", "c"} {
+		require.Nil(t, m.Put(filename, strings.NewReader("hello "+filename)))
+	}
+
+	specs := []FileSpec{{Extension: ".txt"}}
+
+	// Resume after "a"
+	progress, err := m.Warm(context.Background(), nil, specs, WithWarmResume("a"))
+	require.Nil(t, err)
+	require.Equal(t, 2, progress.Files)
+	require.Equal(t, 2, progress.Generated)
+	require.Equal(t, "c", progress.Checkpoint)
+
+	// Existing variants are skipped
+	progress, err = m.Warm(context.Background(), nil, specs, WithWarmConcurrency(3))
+	require.Nil(t, err)
+	require.Equal(t, 3, progress.Files)
+	require.Equal(t, 1, progress.Generated)
+	require.Equal(t, 2, progress.Skipped)
+
+	// Lists of filenames must include the checkpoint
+	progress, err = m.Warm(context.Background(), slices.Values([]string{"b", "c"}), specs, WithWarmResume("b"))
+	require.Nil(t, err)
+	require.Equal(t, 1, progress.Files)
+
+	progress, err = m.Warm(context.Background(), slices.Values([]string{"b", "c"}), specs, WithWarmResume("a"))
+	require.Equal(t, http.StatusBadRequest, derp.ErrorCode(err))
+	require.Equal(t, 0, progress.Files)
+
+	// Original filesystems that cannot be walked are errors, not empty
+	missing := New(afero.NewBasePathFs(afero.NewOsFs(), filepath.Join(t.TempDir(), "missing")), afero.NewMemMapFs(), &working)
+	progress, err = missing.Warm(context.Background(), nil, specs)
+	require.NotNil(t, err)
+	require.Equal(t, 0, progress.Files)
+}
+
+func TestGC(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	processed := afero.NewMemMapFs()
+	m := New(original, processed, &working, WithCacheLimits(CacheLimits{MaxBytes: 20}))
+
+	spec := FileSpec{Extension: ".txt"}
+
+	for _, filename := range []string{"a", "b", "c"} {
+		require.Nil(t, m.Put(filename, strings.NewReader("0123456789"), WithVariants(spec)))
+		time.Sleep(time.Millisecond)
+	}
+
+	// Use "a" again, so that "b" is the least recently used file
+	spec.Filename = "a"
+	spec.OriginalExtension = ".txt"
+	require.Nil(t, m.Generate(spec))
+
+	result, err := m.GC()
+	require.Nil(t, err)
+	require.Equal(t, 1, result.Removed)
+	require.Equal(t, int64(20), result.Bytes)
+
+	exists, _ := afero.Exists(processed, "b/cached.txt")
+	require.False(t, exists)
+
+	// Originals are never removed
+	exists, _ = afero.Exists(original, "b")
+	require.True(t, exists)
+}
+
+func TestGC_DotFolder(t *testing.T) {
+
+	// Processed filesystems may be stored in hidden folders, such as "./.cache"
+	processed := afero.NewBasePathFs(afero.NewOsFs(), filepath.Join(t.TempDir(), ".cache"))
+	require.Nil(t, processed.MkdirAll("notes", 0777))
+	require.Nil(t, processed.MkdirAll(".staging", 0777))
+	require.Nil(t, afero.WriteFile(processed, "notes/cached.txt", []byte("hello world"), 0666))
+	require.Nil(t, afero.WriteFile(processed, ".staging/partial", []byte("partial"), 0666))
+
+	cache := newCacheManager()
+	require.Nil(t, cache.load(processed))
+	require.Equal(t, int64(11), cache.bytes)
+	require.Contains(t, cache.entries, "notes/cached.txt")
+
+	// Stale variants are also found in hidden folders
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	require.Nil(t, processed.MkdirAll("photo", 0777))
+	require.Nil(t, afero.WriteFile(processed, "photo/cached_w300_h300_p0.webp", []byte("old pipeline"), 0666))
+
+	removed, err := New(afero.NewMemMapFs(), processed, &working).PurgeStaleVariants()
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+}
+
+func TestPurgeVariants(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	processed := afero.NewMemMapFs()
+	m := New(original, processed, &working)
+
+	handler := NewHandler(m)
+	require.Nil(t, m.Put("notes", strings.NewReader("hello world")))
+
+	// Serve the file once, so that it exists in both cache tiers
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notes.txt", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.True(t, working.Exists("notes.txt"))
+
+	// Predicates that do not match leave the variant in place
+	require.Nil(t, m.PurgeVariantsFunc("notes", func(filespec FileSpec) bool {
+		return filespec.Extension == ".webp"
+	}))
+
+	exists, _ := afero.Exists(processed, "notes/cached.txt")
+	require.True(t, exists)
+
+	// Originals whose names begin with the same prefix are not affected
+	require.Nil(t, m.Put("notes_w1", strings.NewReader("hello world")))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notes_w1.txt", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.True(t, working.Exists("notes_w1.txt"))
+
+	// Purge all variants
+	require.Nil(t, m.PurgeVariants("notes"))
+
+	exists, _ = afero.Exists(processed, "notes/cached.txt")
+	require.False(t, exists)
+	require.Eventually(t, func() bool { return !working.Exists("notes.txt") }, time.Second, 10*time.Millisecond)
+	require.True(t, working.Exists("notes_w1.txt"))
+
+	// The original is still there
+	exists, _ = afero.Exists(original, "notes")
+	require.True(t, exists)
+
+	// Delete also removes files that PurgeVariants cannot parse
+	require.Nil(t, afero.WriteFile(processed, "notes/unknown", []byte("unknown"), 0666))
+	require.Nil(t, m.Delete("notes"))
+
+	exists, _ = afero.Exists(processed, "notes")
+	require.False(t, exists)
+}
+
+func TestPut_Replace(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	m := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working)
+	handler := NewHandler(m)
+
+	first, err := m.Upload("notes", strings.NewReader("first"))
+	require.Nil(t, err)
+	require.False(t, first.Replaced)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notes.txt?v="+first.Version, nil))
+	require.Equal(t, "first", recorder.Body.String())
+
+	// Replacing the original purges stale variants and changes the version
+	second, err := m.Upload("notes", strings.NewReader("second version"))
+	require.Nil(t, err)
+	require.True(t, second.Replaced)
+	require.NotEqual(t, first.Version, second.Version)
+
+	require.Eventually(t, func() bool {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notes.txt", nil))
+		return recorder.Body.String() == "second version"
+	}, time.Second, 10*time.Millisecond)
+
+	// Old version URLs are served with the current content
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notes.txt?v="+first.Version, nil))
+	require.Equal(t, "second version", recorder.Body.String())
+}
+
+func TestPurgeStaleVariants(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	processed := afero.NewMemMapFs()
+	m := New(afero.NewMemMapFs(), processed, &working)
+
+	current := FileSpec{Filename: "photo", Extension: ".webp", Width: 300, Height: 300}
+	require.Contains(t, current.ProcessedFilename(), "_p")
+
+	require.Nil(t, afero.WriteFile(processed, current.ProcessedPath(), []byte("current"), 0666))
+	require.Nil(t, afero.WriteFile(processed, "photo/cached_w300_h300.webp", []byte("legacy"), 0666))
+	require.Nil(t, afero.WriteFile(processed, "photo/cached_w300_h300_p0.webp", []byte("old pipeline"), 0666))
+	require.Nil(t, afero.WriteFile(processed, "notes/cached.txt", []byte("not processed by FFmpeg"), 0666))
+
+	removed, err := m.PurgeStaleVariants()
+	require.Nil(t, err)
+	require.Equal(t, 2, removed)
+
+	exists, _ := afero.Exists(processed, current.ProcessedPath())
+	require.True(t, exists)
+
+	exists, _ = afero.Exists(processed, "notes/cached.txt")
+	require.True(t, exists)
+}
+
+func TestVariants(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	processed := afero.NewMemMapFs()
+	m := New(afero.NewMemMapFs(), processed, &working)
+
+	current := FileSpec{Filename: "photo", Extension: ".webp", Width: 300, Height: 200, Version: "abc"}
+	require.Nil(t, afero.WriteFile(processed, current.ProcessedPath(), []byte("current"), 0666))
+	require.Nil(t, afero.WriteFile(processed, "photo/cached_w300_h300.webp", []byte("legacy"), 0666))
+	require.Nil(t, afero.WriteFile(processed, "photo/unrelated.txt", []byte("ignored"), 0666))
+
+	variants, err := m.Variants("photo")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(variants))
+
+	for _, variant := range variants {
+		require.Equal(t, "photo", variant.FileSpec.Filename)
+		require.Equal(t, ".webp", variant.FileSpec.Extension)
+		require.Equal(t, 300, variant.FileSpec.Width)
+
+		if variant.Stale {
+			require.Equal(t, int64(6), variant.Size)
+		} else {
+			require.Equal(t, 200, variant.FileSpec.Height)
+			require.Equal(t, "abc", variant.FileSpec.Version)
+			require.Equal(t, current.ProcessedPath(), variant.Path)
+		}
+	}
+
+	// Files with no variants return an empty list
+	variants, err = m.Variants("missing")
+	require.Nil(t, err)
+	require.Empty(t, variants)
+}
+
+func TestUpload_Limits(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	m := New(original, afero.NewMemMapFs(), &working, WithUploadLimits(UploadLimits{MaxBytes: 10}))
+
+	// Server limits apply to every Put, and partial writes are removed
+	_, err := m.Upload("large", strings.NewReader("hello world"))
+	require.True(t, errors.As(err, &UploadError{}))
+	require.Equal(t, http.StatusRequestEntityTooLarge, derp.ErrorCode(err))
+
+	exists, err := afero.Exists(original, "large")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// Individual Puts can override the server limits
+	_, err = m.Upload("large", strings.NewReader("hello world"), WithMaxUploadBytes(100))
+	require.Nil(t, err)
+
+	// Mime types are sniffed from the upload, which is still saved completely
+	_, err = m.Upload("text", strings.NewReader("hello"), WithAllowedMimeTypes("text/*"))
+	require.Nil(t, err)
+
+	content, err := afero.ReadFile(original, "text")
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(content))
+
+	_, err = m.Upload("image", strings.NewReader("hello"), WithAllowedMimeTypes("image/*", "video/mp4"))
+	require.Equal(t, http.StatusUnsupportedMediaType, derp.ErrorCode(err))
+
+	exists, err = afero.Exists(original, "image")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestUpload_Conditional(t *testing.T) {
+
+	for _, contentAddressed := range []bool{false, true} {
+
+		working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+		defer working.Close()
+
+		options := []Option{}
+
+		if contentAddressed {
+			options = append(options, WithContentAddressing())
+		}
+
+		ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working, options...)
+
+		// Create-only uploads succeed once, then conflict
+		_, err := ms.Upload("notes", strings.NewReader("hello world"), WithCreateOnly())
+		require.Nil(t, err)
+
+		_, err = ms.Upload("notes", strings.NewReader("goodbye"), WithCreateOnly())
+		require.IsType(t, ConflictError{}, derp.RootCause(err))
+		require.Equal(t, http.StatusPreconditionFailed, derp.ErrorCode(err))
+
+		// If-Match requires an existing file
+		_, err = ms.Upload("missing", strings.NewReader("hello world"), WithIfMatch("*"))
+		require.Equal(t, http.StatusPreconditionFailed, derp.ErrorCode(err))
+
+		// If-Match accepts the current ETag, but not a stale one
+		etag, err := ms.ETag("notes")
+		require.Nil(t, err)
+		require.True(t, strings.HasPrefix(etag, `W/"`))
+
+		_, err = ms.Upload("notes", strings.NewReader("hello again"), WithIfMatch(`"stale"`))
+		require.Equal(t, http.StatusPreconditionFailed, derp.ErrorCode(err))
+
+		_, err = ms.Upload("notes", strings.NewReader("hello again"), WithIfMatch(etag))
+		require.Nil(t, err)
+
+		// If-Match accepts the SHA-256 digest of the current contents
+		_, err = ms.Upload("notes", strings.NewReader("third"), WithIfMatch(hexSHA256("hello world")))
+		require.Equal(t, http.StatusPreconditionFailed, derp.ErrorCode(err))
+
+		_, err = ms.Upload("notes", strings.NewReader("third"), WithIfMatch(hexSHA256("hello again")))
+		require.Nil(t, err)
+
+		// The Handler maps conditional headers onto these options
+		handler := NewHandler(ms)
+
+		request := httptest.NewRequest(http.MethodPut, "/notes", strings.NewReader("fourth"))
+		request.Header.Set("If-None-Match", "*")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+
+		request = httptest.NewRequest(http.MethodPut, "/notes", strings.NewReader("fourth"))
+		request.Header.Set("If-Match", `"stale", `+hexSHA256("third"))
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	}
+}
+
+func TestUpload_FailedReplacement(t *testing.T) {
+
+	for _, contentAddressed := range []bool{false, true} {
+
+		working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+		defer working.Close()
+
+		options := []Option{}
+
+		if contentAddressed {
+			options = append(options, WithContentAddressing())
+		}
+
+		original := afero.NewMemMapFs()
+		ms := New(original, afero.NewMemMapFs(), &working, options...)
+
+		first, err := ms.Upload("notes", strings.NewReader("hello world"), WithVariants(FileSpec{Extension: ".txt"}))
+		require.Nil(t, err)
+
+		// Rejected replacements leave the original and its variants untouched
+		_, err = ms.Upload("notes", strings.NewReader("hello again, world"), WithMaxUploadBytes(5))
+		require.Equal(t, http.StatusRequestEntityTooLarge, derp.ErrorCode(err))
+
+		_, err = ms.Upload("notes", strings.NewReader("corrupt"), WithExpectedDigest(hexSHA256("something else")))
+		require.Equal(t, http.StatusBadRequest, derp.ErrorCode(err))
+
+		content, err := afero.ReadFile(original, "notes")
+		require.Nil(t, err)
+
+		if !contentAddressed {
+			require.Equal(t, "hello world", string(content))
+		}
+
+		version, err := ms.Version("notes")
+		require.Nil(t, err)
+		require.Equal(t, first.Version, version)
+
+		variants, err := ms.Variants("notes")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(variants))
+
+		// Nothing is left behind in the staging folder
+		entries, err := afero.ReadDir(original, stagingFolder)
+		require.Nil(t, err)
+		require.Empty(t, entries)
+	}
+}
+
+func TestGenerate_Staged(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	processed := afero.NewMemMapFs()
+	ms := New(afero.NewMemMapFs(), processed, &working, WithWorkers(1))
+
+	require.Nil(t, ms.Put("notes", strings.NewReader("hello world")))
+
+	// Processed files are renamed into place once they are complete
+	filespec := FileSpec{Filename: "notes", Extension: ".txt", OriginalExtension: ".txt"}
+	require.Nil(t, ms.Generate(filespec))
+
+	content, err := afero.ReadFile(processed, filespec.ProcessedPath())
+	require.Nil(t, err)
+	require.Equal(t, "hello world", string(content))
+
+	// Failures leave nothing behind for other requests to serve
+	failing := FileSpec{Filename: "missing", Extension: ".txt", OriginalExtension: ".txt"}
+	require.NotNil(t, ms.Generate(failing))
+
+	exists, err := afero.Exists(processed, failing.ProcessedPath())
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	entries, err := afero.ReadDir(processed, stagingFolder)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,287 @@
+package mediaserver
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/benpate/derp"
+)
+
+// DefaultFetchMaxBytes is the largest file that PutFromURL downloads, unless
+// WithFetchMaxBytes or WithUploadLimits sets a different limit.
+const DefaultFetchMaxBytes = 100 << 20
+
+// FetchOption configures a single call to PutFromURL
+type FetchOption func(*fetchConfig)
+
+type fetchConfig struct {
+	timeout      time.Duration
+	maxBytes     int64
+	maxRedirects int
+	mimeTypes    []string
+	allowPrivate bool
+	userAgent    string
+	putOptions   []PutOption
+}
+
+// WithFetchTimeout limits the total time spent connecting to the remote server and downloading the file.
+// The default is 30 seconds.
+func WithFetchTimeout(timeout time.Duration) FetchOption {
+	return func(config *fetchConfig) {
+		config.timeout = timeout
+	}
+}
+
+// WithFetchMaxBytes rejects remote files that are larger than this number of bytes.
+// The default is the server's UploadLimits.MaxBytes, or DefaultFetchMaxBytes.
+func WithFetchMaxBytes(maxBytes int64) FetchOption {
+	return func(config *fetchConfig) {
+		config.maxBytes = maxBytes
+	}
+}
+
+// WithFetchMaxRedirects sets the number of redirects that will be followed.  The default is 5.
+func WithFetchMaxRedirects(maxRedirects int) FetchOption {
+	return func(config *fetchConfig) {
+		config.maxRedirects = maxRedirects
+	}
+}
+
+// WithFetchMimeTypes rejects remote files whose Content-Type header does not match one of
+// these values.  Values may end in "/*" to allow every subtype, such as "image/*".  The default
+// is the server's UploadLimits.MimeTypes, or any image, audio, or video type.
+func WithFetchMimeTypes(mimeTypes ...string) FetchOption {
+	return func(config *fetchConfig) {
+		config.mimeTypes = mimeTypes
+	}
+}
+
+// WithFetchAllowPrivate allows downloads from loopback, private, and link-local addresses.
+// These are blocked by default so that remote users cannot reach internal services.
+// This is mostly useful for testing.
+func WithFetchAllowPrivate() FetchOption {
+	return func(config *fetchConfig) {
+		config.allowPrivate = true
+	}
+}
+
+// WithFetchUserAgent sets the User-Agent header sent to the remote server
+func WithFetchUserAgent(userAgent string) FetchOption {
+	return func(config *fetchConfig) {
+		config.userAgent = userAgent
+	}
+}
+
+// WithFetchPutOptions applies PutOptions (such as WithVariants) to the downloaded file
+func WithFetchPutOptions(options ...PutOption) FetchOption {
+	return func(config *fetchConfig) {
+		config.putOptions = append(config.putOptions, options...)
+	}
+}
+
+// PutFromURL downloads a remote file and uploads it into the original filesystem.
+// Only http and https URLs are allowed, and (by default) connections to loopback, private,
+// and link-local addresses are refused, even after DNS resolution or redirects.  Remote files
+// that are too large, are not an allowed type, or cannot be downloaded return an UploadError.
+func (ms MediaServer) PutFromURL(ctx context.Context, filename string, remoteURL string, options ...FetchOption) (PutResult, error) {
+
+	const location = "mediaserver.PutFromURL"
+
+	config := fetchConfig{
+		timeout:      30 * time.Second,
+		maxBytes:     ms.uploadLimits.MaxBytes,
+		maxRedirects: 5,
+		mimeTypes:    ms.uploadLimits.MimeTypes,
+	}
+
+	if config.maxBytes <= 0 {
+		config.maxBytes = DefaultFetchMaxBytes
+	}
+
+	if len(config.mimeTypes) == 0 {
+		config.mimeTypes = []string{"image/*", "audio/*", "video/*"}
+	}
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	if err := ms.ValidateFilename(filename); err != nil {
+		return PutResult{}, derp.Wrap(err, location, "Invalid filename", filename)
+	}
+
+	parsedURL, err := url.Parse(remoteURL)
+
+	if err != nil {
+		return PutResult{}, derp.Wrap(err, location, "Invalid URL", remoteURL, derp.WithBadRequest())
+	}
+
+	if err := checkFetchScheme(filename, parsedURL); err != nil {
+		return PutResult{}, derp.Wrap(err, location, "Unsupported URL", remoteURL)
+	}
+
+	// Build a client that only connects to allowed addresses
+	ctx, cancel := context.WithTimeout(ctx, config.timeout)
+	defer cancel()
+
+	client := config.client(filename)
+	defer client.CloseIdleConnections()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, parsedURL.String(), nil)
+
+	if err != nil {
+		return PutResult{}, derp.Wrap(err, location, "Unable to create request", remoteURL, derp.WithBadRequest())
+	}
+
+	if config.userAgent != "" {
+		request.Header.Set("User-Agent", config.userAgent)
+	}
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return PutResult{}, derp.Wrap(fetchError(filename, err), location, "Unable to download remote file", remoteURL)
+	}
+
+	defer response.Body.Close()
+
+	// Check the response before reading its body
+	if (response.StatusCode < 200) || (response.StatusCode > 299) {
+		err := UploadError{Filename: filename, Code: http.StatusBadGateway, Reason: "remote server returned " + response.Status}
+		return PutResult{}, derp.Wrap(err, location, "Unable to download remote file", remoteURL)
+	}
+
+	if response.ContentLength > config.maxBytes {
+		err := UploadError{Filename: filename, Code: http.StatusRequestEntityTooLarge, Reason: "remote file is larger than " + strconv.FormatInt(config.maxBytes, 10) + " bytes"}
+		return PutResult{}, derp.Wrap(err, location, "Remote file is too large", remoteURL)
+	}
+
+	mimeType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+
+	if !matchesMimeType(mimeType, config.mimeTypes) {
+		err := UploadError{Filename: filename, Code: http.StatusUnsupportedMediaType, Reason: "remote content type " + strconv.Quote(mimeType) + " is not allowed"}
+		return PutResult{}, derp.Wrap(err, location, "Remote file is not an allowed type", remoteURL)
+	}
+
+	// Upload the body, which still enforces the size limit when Content-Length is missing or wrong
+	putOptions := append([]PutOption{WithMaxUploadBytes(config.maxBytes)}, config.putOptions...)
+	result, err := ms.Upload(filename, response.Body, putOptions...)
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return result, derp.Wrap(fetchError(filename, err), location, "Unable to download remote file", remoteURL)
+	}
+
+	if err != nil {
+		return result, derp.Wrap(err, location, "Unable to upload remote file", remoteURL)
+	}
+
+	return result, nil
+}
+
+// client returns an HTTP client that enforces the redirect and address limits of this configuration
+func (config fetchConfig) client(filename string) *http.Client {
+
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+
+	if !config.allowPrivate {
+		dialer.Control = func(_ string, address string, _ syscall.RawConn) error {
+
+			addrPort, err := netip.ParseAddrPort(address)
+
+			if err != nil {
+				return err
+			}
+
+			if isBlockedAddress(addrPort.Addr()) {
+				return UploadError{Filename: filename, Code: http.StatusForbidden, Reason: "address " + addrPort.Addr().String() + " is not allowed"}
+			}
+
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil, // Proxies would connect to addresses that are not checked
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: config.timeout,
+			MaxIdleConns:          1,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+
+			if len(via) > config.maxRedirects {
+				return UploadError{Filename: filename, Code: http.StatusBadGateway, Reason: "remote server redirected more than " + strconv.Itoa(config.maxRedirects) + " times"}
+			}
+
+			return checkFetchScheme(filename, request.URL)
+		},
+	}
+}
+
+// checkFetchScheme returns an UploadError unless the URL uses http or https
+func checkFetchScheme(filename string, remoteURL *url.URL) error {
+
+	if (remoteURL.Scheme == "http") || (remoteURL.Scheme == "https") {
+		return nil
+	}
+
+	return UploadError{Filename: filename, Code: http.StatusBadRequest, Reason: "URL scheme " + strconv.Quote(remoteURL.Scheme) + " is not allowed"}
+}
+
+// fetchError unwraps the UploadError (if any) inside an HTTP client error, so that its
+// code is reported, and reports timeouts as a 504 Gateway Timeout.
+func fetchError(filename string, err error) error {
+
+	var uploadError UploadError
+
+	if errors.As(err, &uploadError) {
+		return uploadError
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return UploadError{Filename: filename, Code: http.StatusGatewayTimeout, Reason: "remote file took too long to download"}
+	}
+
+	return derp.Wrap(err, "mediaserver.fetchError", "Unable to download remote file", derp.WithCode(http.StatusBadGateway))
+}
+
+// blockedPrefixes are special-purpose networks that are not covered by the netip.Addr checks
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "This" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which can reach IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4, which can reach IPv4 addresses
+	netip.MustParsePrefix("fec0::/10"),      // Deprecated site-local
+}
+
+// isBlockedAddress returns TRUE if the address is loopback, private, link-local,
+// multicast, or otherwise not a public unicast address.
+func isBlockedAddress(addr netip.Addr) bool {
+
+	addr = addr.Unmap()
+
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return true
+	}
+
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,110 @@
+package mediaserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutFromURL(t *testing.T) {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("\x89PNG\r\n\x1a\nfake image"))
+	})
+
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte(strings.Repeat("x", 2048)))
+	})
+
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	})
+
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/redirect/"+r.URL.Path, http.StatusFound)
+	})
+
+	mux.HandleFunc("/redirect-once", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/image.png", http.StatusFound)
+	})
+
+	remote := httptest.NewServer(mux)
+	defer remote.Close()
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working)
+	ctx := context.Background()
+
+	// Loopback addresses are blocked by default
+	_, err := ms.PutFromURL(ctx, "blocked", remote.URL+"/image.png")
+	require.Equal(t, http.StatusForbidden, derp.ErrorCode(err))
+
+	exists, err := afero.Exists(original, "blocked")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// Only http and https are allowed
+	_, err = ms.PutFromURL(ctx, "file", "file:///etc/passwd")
+	require.Equal(t, http.StatusBadRequest, derp.ErrorCode(err))
+
+	// Allowed downloads are uploaded, following a limited number of redirects
+	allowPrivate := WithFetchAllowPrivate()
+
+	result, err := ms.PutFromURL(ctx, "image", remote.URL+"/redirect-once", allowPrivate)
+	require.Nil(t, err)
+	require.Equal(t, hexSHA256("\x89PNG\r\n\x1a\nfake image"), result.Digest)
+
+	_, err = ms.PutFromURL(ctx, "loop", remote.URL+"/redirect/", allowPrivate)
+	require.Equal(t, http.StatusBadGateway, derp.ErrorCode(err))
+
+	// Remote errors, content types, sizes, and timeouts are enforced
+	_, err = ms.PutFromURL(ctx, "missing", remote.URL+"/missing.png", allowPrivate)
+	require.Equal(t, http.StatusBadGateway, derp.ErrorCode(err))
+
+	_, err = ms.PutFromURL(ctx, "page", remote.URL+"/page.html", allowPrivate)
+	require.Equal(t, http.StatusUnsupportedMediaType, derp.ErrorCode(err))
+
+	_, err = ms.PutFromURL(ctx, "large", remote.URL+"/large.png", allowPrivate, WithFetchMaxBytes(1024))
+	require.Equal(t, http.StatusRequestEntityTooLarge, derp.ErrorCode(err))
+
+	_, err = ms.PutFromURL(ctx, "slow", remote.URL+"/slow.png", allowPrivate, WithFetchTimeout(50*time.Millisecond))
+	require.Equal(t, http.StatusGatewayTimeout, derp.ErrorCode(err))
+}
+
+func TestIsBlockedAddress(t *testing.T) {
+
+	blocked := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "64:ff9b::a00:1"}
+
+	for _, value := range blocked {
+		require.True(t, isBlockedAddress(netip.MustParseAddr(value)), value)
+	}
+
+	allowed := []string{"93.184.216.34", "2606:2800:220:1::1"}
+
+	for _, value := range allowed {
+		require.False(t, isBlockedAddress(netip.MustParseAddr(value)), value)
+	}
+}
@@ -0,0 +1,64 @@
+package mediaserver
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// Variant describes a single processed version of an original file that exists in the processed cache.
+type Variant struct {
+	FileSpec FileSpec  // Parameters that were used to generate this variant
+	Path     string    // Path of the variant within the processed filesystem
+	Size     int64     // Size of the variant, in bytes
+	ModTime  time.Time // Time that the variant was generated
+	Stale    bool      // TRUE if the variant was generated by an older processing pipeline
+}
+
+// Variants lists all of the processed variants that currently exist for an original file.
+// Files in the processed directory that were not created by the MediaServer are ignored.
+func (ms MediaServer) Variants(filename string) ([]Variant, error) {
+
+	if err := ms.ValidateFilename(filename); err != nil {
+		return nil, derp.Wrap(err, "mediaserver.Variants", "Invalid filename", filename)
+	}
+
+	entries, err := afero.ReadDir(ms.processed, filename)
+
+	if err != nil {
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return make([]Variant, 0), nil
+		}
+
+		return nil, derp.Wrap(err, "mediaserver.Variants", "Unable to read processed directory", filename)
+	}
+
+	result := make([]Variant, 0, len(entries))
+
+	for _, entry := range entries {
+
+		if entry.IsDir() {
+			continue
+		}
+
+		filespec, ok := parseProcessedFilename(filename, entry.Name())
+
+		if !ok {
+			continue
+		}
+
+		result = append(result, Variant{
+			FileSpec: filespec,
+			Path:     filespec.ProcessedDir() + "/" + entry.Name(),
+			Size:     entry.Size(),
+			ModTime:  entry.ModTime(),
+			Stale:    filespec.pipeline != filespec.pipelineVersion(),
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package mediaserver
+
+import (
+	"hash/fnv"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/benpate/derp"
+)
+
+// ETag returns a weak HTTP entity tag for an original file.  It is calculated from the file's
+// size and modification time (not its contents) so it is cheap to serve, but two different
+// files can share an ETag if they are replaced within the filesystem's timestamp precision.
+// This makes WithIfMatch a best-effort check when it is given an ETag; use the file's
+// SHA-256 digest instead when an exact match is required.
+func (ms MediaServer) ETag(filename string) (string, error) {
+
+	version, err := ms.Version(filename)
+
+	if err != nil {
+		return "", derp.Wrap(err, "mediaserver.ETag", "Unable to calculate version", filename)
+	}
+
+	return `W/"` + version + `"`, nil
+}
+
+// Version returns a short string that changes whenever the original file is replaced.
+// Include it in FileSpecs (and URLs) so that caches and CDNs see new URLs for new content.
+func (ms MediaServer) Version(filename string) (string, error) {
+
+	if err := ms.ValidateFilename(filename); err != nil {
+		return "", derp.Wrap(err, "mediaserver.Version", "Invalid filename", filename)
+	}
+
+	info, err := ms.statOriginal(filename)
+
+	if err != nil {
+		return "", derp.Wrap(err, "mediaserver.Version", "Unable to stat original file", filename)
+	}
+
+	return fileVersion(info), nil
+}
+
+// fileVersion calculates the Version of an original file from its size and modification time
+func fileVersion(info fs.FileInfo) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(strconv.FormatInt(info.ModTime().UnixNano(), 10)))
+	hash.Write([]byte(strconv.FormatInt(info.Size(), 10)))
+
+	return strconv.FormatUint(hash.Sum64(), 36)
+}
+
+// opaqueTag removes the weak indicator and quotes from an HTTP entity tag, so that
+// tags can be compared whether or not the client preserved them
+func opaqueTag(value string) string {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+	return strings.Trim(value, `"`)
+}
@@ -0,0 +1,298 @@
+package mediaserver
+
+import (
+	"context"
+	"io/fs"
+	"iter"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// WarmProgress reports the progress of a Warm operation after each original file is finished.
+type WarmProgress struct {
+	Filename   string // The original file that was just finished
+	Checkpoint string // The last filename that can be safely passed to WithWarmResume
+	Files      int    // Number of original files finished so far
+	Generated  int    // Number of variants generated so far
+	Skipped    int    // Number of variants that already existed
+	Failed     int    // Number of variants that could not be generated
+}
+
+// WarmOption modifies the behavior of a Warm operation
+type WarmOption func(*warmConfig)
+
+type warmConfig struct {
+	concurrency int
+	resumeAfter string
+	onProgress  func(WarmProgress)
+}
+
+// WithWarmConcurrency sets the number of original files that are warmed at the same time.
+// The default is the size of the MediaServer's worker pool (or 1 if there is no worker pool).
+func WithWarmConcurrency(concurrency int) WarmOption {
+	return func(config *warmConfig) {
+		config.concurrency = concurrency
+	}
+}
+
+// WithWarmResume skips every filename up to (and including) the provided checkpoint,
+// which is usually the Checkpoint reported by an earlier, interrupted Warm operation.
+// If Warm is given a list of filenames that does not include the checkpoint, then
+// nothing is warmed and Warm returns an error.
+func WithWarmResume(checkpoint string) WarmOption {
+	return func(config *warmConfig) {
+		config.resumeAfter = checkpoint
+	}
+}
+
+// WithWarmProgress calls the provided function each time an original file is finished.
+func WithWarmProgress(callback func(WarmProgress)) WarmOption {
+	return func(config *warmConfig) {
+		config.onProgress = callback
+	}
+}
+
+// Warm generates processed variants for many original files, skipping any variants that already exist.
+// If filenames is nil, then every file in the original filesystem is warmed (in lexical order).
+// The Filename and OriginalExtension of each spec are filled in for every original file.
+// Warm stops early if the context is cancelled, and the returned WarmProgress includes
+// a Checkpoint that can be used to resume the operation later.
+func (ms MediaServer) Warm(ctx context.Context, filenames iter.Seq[string], specs []FileSpec, options ...WarmOption) (WarmProgress, error) {
+
+	const location = "mediaserver.Warm"
+
+	config := warmConfig{
+		concurrency: max(cap(ms.workers), 1),
+	}
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	// Skip files until the checkpoint is reached.  The original filesystem is walked
+	// in lexical order, so files can be skipped even if the checkpoint has since been removed.
+	// Other lists of filenames must include the checkpoint.
+	checkpointFound := func() bool { return true }
+	walkErr := func() error { return nil }
+
+	if filenames == nil {
+		filenames, walkErr = ms.originalFilenames(config.resumeAfter)
+	} else if config.resumeAfter != "" {
+		filenames, checkpointFound = skipThrough(filenames, config.resumeAfter)
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	progress := WarmProgress{}
+	tracker := newCheckpointTracker()
+	semaphore := make(chan struct{}, max(config.concurrency, 1))
+
+	for filename := range filenames {
+
+		// Stop dispatching new files if the context is cancelled
+		if ctx.Err() != nil {
+			break
+		}
+
+		mutex.Lock()
+		index := tracker.start(filename)
+		mutex.Unlock()
+
+		semaphore <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			generated, skipped, failed, complete := ms.warmFile(ctx, filename, specs)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			// Files that were interrupted by a cancelled context do not advance the checkpoint
+			if complete {
+				progress.Checkpoint = tracker.finish(index)
+			}
+
+			progress.Filename = filename
+			progress.Files++
+			progress.Generated += generated
+			progress.Skipped += skipped
+			progress.Failed += failed
+
+			if config.onProgress != nil {
+				config.onProgress(progress)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return progress, derp.Wrap(err, location, "Warm operation was cancelled", progress.Checkpoint)
+	}
+
+	if err := walkErr(); err != nil {
+		return progress, derp.Wrap(err, location, "Unable to list original files", progress.Checkpoint)
+	}
+
+	if !checkpointFound() {
+		return progress, derp.BadRequest(location, "Checkpoint is not in the list of filenames", config.resumeAfter)
+	}
+
+	return progress, nil
+}
+
+// warmFile generates all of the requested variants for a single original file.
+// It returns FALSE for complete if the context was cancelled before all variants were attempted.
+func (ms MediaServer) warmFile(ctx context.Context, filename string, specs []FileSpec) (generated int, skipped int, failed int, complete bool) {
+
+	const location = "mediaserver.warmFile"
+
+	originalExtension, err := ms.DetectExtension(filename)
+
+	if err != nil {
+		derp.Report(derp.Wrap(err, location, "Unable to detect original file type", filename))
+		return 0, 0, len(specs), true
+	}
+
+	for _, spec := range specs {
+
+		if ctx.Err() != nil {
+			return generated, skipped, failed, false
+		}
+
+		spec.Filename = filename
+		spec.OriginalExtension = originalExtension
+
+		if exists, _ := afero.Exists(ms.processed, spec.ProcessedPath()); exists {
+			skipped++
+			continue
+		}
+
+		if err := ms.Generate(spec); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to generate variant", spec))
+			failed++
+			continue
+		}
+
+		generated++
+	}
+
+	return generated, skipped, failed, true
+}
+
+// originalFilenames returns an iterator over every file in the original filesystem
+// that sorts after the provided filename, in lexical order.  The returned function
+// reports the error (if any) that stopped the last iteration early.
+func (ms MediaServer) originalFilenames(after string) (iter.Seq[string], func() error) {
+
+	var walkErr error
+
+	result := func(yield func(string) bool) {
+
+		walkErr = afero.Walk(ms.original, "", func(path string, info fs.FileInfo, err error) error {
+
+			if err != nil {
+				return err
+			}
+
+			// Skip hidden directories (such as content-addressed storage)
+			if info.IsDir() {
+				if (path != "") && strings.HasPrefix(info.Name(), ".") {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			filename := strings.TrimPrefix(path, "/")
+
+			// Compare path segments (not whole strings) to match the order that afero.Walk uses
+			if slices.Compare(strings.Split(filename, "/"), strings.Split(after, "/")) <= 0 {
+				return nil
+			}
+
+			if !yield(filename) {
+				return fs.SkipAll
+			}
+
+			return nil
+		})
+
+		if walkErr != nil {
+			walkErr = derp.Wrap(walkErr, "mediaserver.originalFilenames", "Unable to walk original filesystem")
+		}
+	}
+
+	return result, func() error { return walkErr }
+}
+
+// skipThrough skips every value in the iterator up to (and including) the checkpoint value.
+// The returned function reports whether the checkpoint was found during the last iteration.
+func skipThrough(values iter.Seq[string], checkpoint string) (iter.Seq[string], func() bool) {
+
+	found := false
+
+	result := func(yield func(string) bool) {
+
+		found = false
+
+		for value := range values {
+
+			if !found {
+				found = (value == checkpoint)
+				continue
+			}
+
+			if !yield(value) {
+				return
+			}
+		}
+	}
+
+	return result, func() bool { return found }
+}
+
+// checkpointTracker finds the last filename for which every earlier filename is also finished,
+// even when files are processed concurrently and finish out of order.
+type checkpointTracker struct {
+	filenames []string
+	finished  []bool
+	next      int
+}
+
+func newCheckpointTracker() *checkpointTracker {
+	return &checkpointTracker{}
+}
+
+// start records a new filename and returns its index. This must be called in iteration order.
+func (tracker *checkpointTracker) start(filename string) int {
+	tracker.filenames = append(tracker.filenames, filename)
+	tracker.finished = append(tracker.finished, false)
+	return len(tracker.filenames) - 1
+}
+
+// finish marks a filename as finished and returns the current checkpoint.
+func (tracker *checkpointTracker) finish(index int) string {
+
+	tracker.finished[index] = true
+
+	for (tracker.next < len(tracker.finished)) && tracker.finished[tracker.next] {
+		tracker.next++
+	}
+
+	if tracker.next == 0 {
+		return ""
+	}
+
+	return tracker.filenames[tracker.next-1]
+}
@@ -0,0 +1,160 @@
+package mediaserver
+
+import (
+	"strings"
+	"sync"
+)
+
+// Quota limits the original files that can be stored in a Namespace.  Zero values are unlimited.
+type Quota struct {
+	MaxBytes int64 // Total size of all original files, in bytes
+	MaxFiles int   // Total number of original files
+}
+
+// Usage reports the original files that are stored in a Namespace.
+type Usage struct {
+	Bytes int64 // Total size of all original files, in bytes
+	Files int   // Total number of original files
+}
+
+// namespaceRegistry stores the quotas, usage, and reservations of every namespace.  It is shared by
+// the MediaServer and all of its Namespace views.
+type namespaceRegistry struct {
+	defaultQuota Quota
+	quotas       map[string]Quota
+	usage        map[string]Usage
+	reserved     map[string]Usage
+	mutex        sync.RWMutex
+}
+
+func newNamespaceRegistry() *namespaceRegistry {
+	return &namespaceRegistry{
+		quotas:   make(map[string]Quota),
+		usage:    make(map[string]Usage),
+		reserved: make(map[string]Usage),
+	}
+}
+
+// quota returns the quota for a namespace, falling back to the default quota
+func (registry *namespaceRegistry) quota(namespace string) Quota {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	if quota, ok := registry.quotas[namespace]; ok {
+		return quota
+	}
+
+	return registry.defaultQuota
+}
+
+// setQuota sets the quota for a single namespace
+func (registry *namespaceRegistry) setQuota(namespace string, quota Quota) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.quotas[namespace] = quota
+}
+
+// getUsage returns the tracked usage of a namespace.  It returns FALSE if
+// the namespace's usage has not been loaded yet.
+func (registry *namespaceRegistry) getUsage(namespace string) (Usage, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	usage, ok := registry.usage[namespace]
+	return usage, ok
+}
+
+// loadUsage stores the usage of a namespace (calculated from the filesystem)
+// unless it has already been loaded.  It returns the tracked usage.
+func (registry *namespaceRegistry) loadUsage(namespace string, usage Usage) Usage {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if existing, ok := registry.usage[namespace]; ok {
+		return existing
+	}
+
+	registry.usage[namespace] = usage
+	return usage
+}
+
+// addUsage updates the usage of every namespace that contains the (fully scoped) filename,
+// no matter which view added or removed the file.  Namespaces whose usage has not been
+// loaded yet are ignored, because their usage will be calculated when it is needed.
+func (registry *namespaceRegistry) addUsage(filename string, bytes int64, files int) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for namespace, usage := range registry.usage {
+		if strings.HasPrefix(filename, namespace+"/") {
+			usage.Bytes += bytes
+			usage.Files += files
+			registry.usage[namespace] = usage
+		}
+	}
+}
+
+// reserve holds bytes and files for an upload that is still in progress, so that concurrent
+// uploads cannot exceed the quota together.  It returns FALSE (and reserves nothing) if the
+// reservation would exceed the quota.  It also returns the usage of the namespace, including
+// every reservation.  The namespace's usage must already be loaded.
+func (registry *namespaceRegistry) reserve(namespace string, quota Quota, bytes int64, files int) (Usage, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	usage := registry.usage[namespace]
+	reserved := registry.reserved[namespace]
+
+	total := Usage{
+		Bytes: usage.Bytes + reserved.Bytes,
+		Files: usage.Files + reserved.Files,
+	}
+
+	if (quota.MaxBytes > 0) && (bytes > 0) && (total.Bytes+bytes > quota.MaxBytes) {
+		return total, false
+	}
+
+	if (quota.MaxFiles > 0) && (files > 0) && (total.Files+files > quota.MaxFiles) {
+		return total, false
+	}
+
+	reserved.Bytes += bytes
+	reserved.Files += files
+	registry.reserved[namespace] = reserved
+
+	total.Bytes += bytes
+	total.Files += files
+	return total, true
+}
+
+// reservedUsage returns the usage of a namespace, including every reservation
+func (registry *namespaceRegistry) reservedUsage(namespace string) Usage {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	usage := registry.usage[namespace]
+	reserved := registry.reserved[namespace]
+
+	return Usage{
+		Bytes: usage.Bytes + reserved.Bytes,
+		Files: usage.Files + reserved.Files,
+	}
+}
+
+// release returns bytes and files that were reserved for an upload
+func (registry *namespaceRegistry) release(namespace string, bytes int64, files int) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	reserved := registry.reserved[namespace]
+	reserved.Bytes -= bytes
+	reserved.Files -= files
+
+	if (reserved.Bytes == 0) && (reserved.Files == 0) {
+		delete(registry.reserved, namespace)
+		return
+	}
+
+	registry.reserved[namespace] = reserved
+}
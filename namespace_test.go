@@ -0,0 +1,176 @@
+package mediaserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespace(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	// Use real directories, so that nested folders must be created
+	original := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+	processed := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+	ms := New(original, processed, &working)
+
+	tenantA, err := ms.Namespace("tenant-a")
+	require.Nil(t, err)
+
+	tenantB, err := ms.Namespace("tenant-b")
+	require.Nil(t, err)
+
+	// The same filename stores different files in each Namespace
+	require.Nil(t, tenantA.Put("photos/notes", strings.NewReader("hello a")))
+	require.Nil(t, tenantB.Put("photos/notes", strings.NewReader("hello b")))
+
+	content, err := afero.ReadFile(original, "tenant-a/photos/notes")
+	require.Nil(t, err)
+	require.Equal(t, "hello a", string(content))
+
+	// Variants are served from each Namespace's own files
+	for _, tenant := range []MediaServer{tenantA, tenantB} {
+
+		filespec := NewFileSpec()
+		filespec.Filename = "photos/notes"
+		filespec.OriginalExtension = ".txt"
+		filespec.Extension = ".txt"
+
+		request := httptest.NewRequest(http.MethodGet, "/photos/notes.txt", nil)
+		recorder := httptest.NewRecorder()
+		require.Nil(t, tenant.Serve(recorder, request, filespec))
+		require.Equal(t, "hello "+strings.TrimPrefix(tenant.NamespaceName(), "tenant-"), recorder.Body.String())
+	}
+
+	exists, err := afero.Exists(processed, "tenant-b/photos/notes/cached.txt")
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	// Purging one Namespace does not affect the other
+	require.Nil(t, tenantA.Delete("photos/notes"))
+
+	variants, err := tenantB.Variants("photos/notes")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(variants))
+
+	// Namespace names follow the same rules as filenames
+	_, err = ms.Namespace("../escape")
+	require.NotNil(t, err)
+}
+
+func TestNamespace_Quota(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working,
+		WithDefaultQuota(Quota{MaxFiles: 2}),
+		WithQuota("small", Quota{MaxBytes: 10}),
+	)
+
+	// File-count quotas
+	tenant, err := ms.Namespace("tenant")
+	require.Nil(t, err)
+	require.Nil(t, tenant.Put("a", strings.NewReader("hello")))
+	require.Nil(t, tenant.Put("b", strings.NewReader("hello")))
+	require.Nil(t, tenant.Put("b", strings.NewReader("replaced")))
+
+	err = tenant.Put("c", strings.NewReader("hello"))
+	require.True(t, errors.As(err, &QuotaError{}))
+	require.Equal(t, http.StatusInsufficientStorage, derp.ErrorCode(err))
+
+	usage, err := tenant.Usage()
+	require.Nil(t, err)
+	require.Equal(t, Usage{Bytes: 13, Files: 2}, usage)
+
+	require.Nil(t, tenant.Delete("a"))
+	require.Nil(t, tenant.Put("c", strings.NewReader("hello")))
+
+	// Byte quotas, including uploads that are rejected part way through
+	small, err := ms.Namespace("small")
+	require.Nil(t, err)
+	require.Nil(t, small.Put("a", strings.NewReader("hello")))
+
+	err = small.Put("b", strings.NewReader("hello world"))
+	require.True(t, errors.As(err, &QuotaError{}))
+
+	exists, err := afero.Exists(original, "small/b")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	usage, err = small.Usage()
+	require.Nil(t, err)
+	require.Equal(t, Usage{Bytes: 5, Files: 1}, usage)
+
+	// The MediaServer itself is not limited
+	require.Nil(t, ms.Put("a", strings.NewReader("hello world")))
+	require.Nil(t, ms.Put("b", strings.NewReader("hello world")))
+	require.Nil(t, ms.Put("c", strings.NewReader("hello world")))
+}
+
+func TestNamespace_QuotaReservations(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working,
+		WithQuota("tenant", Quota{MaxBytes: 10}),
+	)
+
+	tenant, err := ms.Namespace("tenant")
+	require.Nil(t, err)
+
+	// Concurrent uploads to different names cannot exceed the quota together
+	var wait sync.WaitGroup
+	var succeeded atomic.Int64
+
+	for index := range 10 {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if tenant.Put("file-"+strconv.Itoa(index), strings.NewReader("hello")) == nil {
+				succeeded.Add(1)
+			}
+		}()
+	}
+
+	wait.Wait()
+	require.Equal(t, int64(2), succeeded.Load())
+
+	usage, err := tenant.Usage()
+	require.Nil(t, err)
+	require.Equal(t, Usage{Bytes: 10, Files: 2}, usage)
+
+	// Files removed (or added) through other views still count against the Namespace
+	list, _, err := tenant.List("", "", 0)
+	require.Nil(t, err)
+	require.Nil(t, ms.Delete("tenant/"+list[0].Filename))
+
+	usage, err = tenant.Usage()
+	require.Nil(t, err)
+	require.Equal(t, Usage{Bytes: 5, Files: 1}, usage)
+
+	require.Nil(t, ms.Put("tenant/other", strings.NewReader("hello")))
+
+	usage, err = tenant.Usage()
+	require.Nil(t, err)
+	require.Equal(t, Usage{Bytes: 10, Files: 2}, usage)
+
+	// Failed uploads release their reservations
+	err = tenant.Put("large", strings.NewReader("hello world"))
+	require.True(t, errors.As(err, &QuotaError{}))
+	require.Empty(t, ms.namespaces.reserved)
+}
@@ -0,0 +1,109 @@
+package mediaserver
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/benpate/rosetta/convert"
+)
+
+// Policy limits the FileSpecs that a MediaServer will process.  Zero values are unrestricted.
+type Policy struct {
+	MaxWidth    int                 // Maximum width (in pixels) that may be requested
+	MaxHeight   int                 // Maximum height (in pixels) that may be requested
+	Widths      []int               // If present, requested widths must be one of these values
+	Heights     []int               // If present, requested heights must be one of these values
+	Extensions  map[string][]string // Allowed output extensions, keyed by the original mime category ("image", "audio", "video").  Categories that are not listed are unrestricted.
+	MinBitrate  int                 // Minimum bitrate (in kbps) that may be requested
+	MaxBitrate  int                 // Maximum bitrate (in kbps) that may be requested
+	PresetsOnly bool                // If TRUE, then only FileSpecs that match one of the Presets are allowed
+	Presets     map[string]Preset   // Presets allowed when PresetsOnly is set.  MediaServers add their registered Presets automatically.
+}
+
+// Validate returns a FileSpecError if the FileSpec is not allowed by the Policy.
+func (filespec *FileSpec) Validate(policy Policy) error {
+
+	// If only presets are allowed, then nothing else matters
+	if policy.PresetsOnly {
+
+		for _, preset := range policy.Presets {
+			if preset.Matches(*filespec) {
+				return nil
+			}
+		}
+
+		return FileSpecError{Field: "Preset", Value: filespec.URL(), Reason: "does not match an allowed preset"}
+	}
+
+	// Dimensions and bitrates can never be negative
+	if filespec.Width < 0 {
+		return FileSpecError{Field: "Width", Value: filespec.Width, Reason: "must not be negative"}
+	}
+
+	if filespec.Height < 0 {
+		return FileSpecError{Field: "Height", Value: filespec.Height, Reason: "must not be negative"}
+	}
+
+	if filespec.Bitrate < 0 {
+		return FileSpecError{Field: "Bitrate", Value: filespec.Bitrate, Reason: "must not be negative"}
+	}
+
+	// Validate width (zero means "original size" which is always allowed)
+	if filespec.Width != 0 {
+
+		if (policy.MaxWidth > 0) && (filespec.Width > policy.MaxWidth) {
+			return FileSpecError{Field: "Width", Value: filespec.Width, Reason: "must not exceed " + convert.String(policy.MaxWidth)}
+		}
+
+		if (len(policy.Widths) > 0) && !slices.Contains(policy.Widths, filespec.Width) {
+			return FileSpecError{Field: "Width", Value: filespec.Width, Reason: "is not an allowed width"}
+		}
+	}
+
+	// Validate height (zero means "original size" which is always allowed)
+	if filespec.Height != 0 {
+
+		if (policy.MaxHeight > 0) && (filespec.Height > policy.MaxHeight) {
+			return FileSpecError{Field: "Height", Value: filespec.Height, Reason: "must not exceed " + convert.String(policy.MaxHeight)}
+		}
+
+		if (len(policy.Heights) > 0) && !slices.Contains(policy.Heights, filespec.Height) {
+			return FileSpecError{Field: "Height", Value: filespec.Height, Reason: "is not an allowed height"}
+		}
+	}
+
+	// Validate bitrate (zero means "default bitrate" which is always allowed)
+	if filespec.Bitrate != 0 {
+
+		if filespec.Bitrate < policy.MinBitrate {
+			return FileSpecError{Field: "Bitrate", Value: filespec.Bitrate, Reason: "must be at least " + convert.String(policy.MinBitrate)}
+		}
+
+		if (policy.MaxBitrate > 0) && (filespec.Bitrate > policy.MaxBitrate) {
+			return FileSpecError{Field: "Bitrate", Value: filespec.Bitrate, Reason: "must not exceed " + convert.String(policy.MaxBitrate)}
+		}
+	}
+
+	// Validate output extension for this kind of original file
+	if extensions, ok := policy.Extensions[filespec.OriginalMimeCategory()]; ok {
+		if !slices.Contains(extensions, filespec.Extension) {
+			return FileSpecError{Field: "Extension", Value: filespec.Extension, Reason: "is not allowed for " + filespec.OriginalMimeCategory() + " files"}
+		}
+	}
+
+	return nil
+}
+
+// Validate returns a FileSpecError if the FileSpec is not allowed by this MediaServer's Policy.
+// Registered Presets are added to the Policy before validating.
+func (ms MediaServer) Validate(filespec FileSpec) error {
+
+	policy := ms.policy
+
+	if policy.PresetsOnly {
+		policy.Presets = ms.presets.all()
+		maps.Copy(policy.Presets, ms.policy.Presets)
+	}
+
+	return filespec.Validate(policy)
+}
@@ -0,0 +1,58 @@
+package mediaserver
+
+import (
+	"testing"
+
+	"github.com/benpate/derp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+
+	policy := Policy{
+		MaxWidth:   2000,
+		Heights:    []int{300, 600},
+		MinBitrate: 64,
+		MaxBitrate: 320,
+		Extensions: map[string][]string{
+			"image": {".webp", ".jpg"},
+		},
+	}
+
+	filespec := func(width int, height int, bitrate int, extension string) FileSpec {
+		return FileSpec{
+			Filename:          "file",
+			OriginalExtension: ".png",
+			Extension:         extension,
+			Width:             width,
+			Height:            height,
+			Bitrate:           bitrate,
+		}
+	}
+
+	valid := func(f FileSpec) {
+		require.Nil(t, f.Validate(policy))
+	}
+
+	invalid := func(f FileSpec) {
+		err := f.Validate(policy)
+		require.NotNil(t, err)
+		require.Equal(t, 400, derp.ErrorCode(err))
+	}
+
+	valid(filespec(0, 0, 0, ".webp"))
+	valid(filespec(1200, 600, 0, ".jpg"))
+	valid(filespec(0, 0, 128, ".webp"))
+
+	invalid(filespec(-1, 0, 0, ".webp"))
+	invalid(filespec(4999, 0, 0, ".webp"))
+	invalid(filespec(0, 301, 0, ".webp"))
+	invalid(filespec(0, 0, 32, ".webp"))
+	invalid(filespec(0, 0, 1000, ".webp"))
+	invalid(filespec(0, 0, 0, ".gif"))
+
+	// Unlisted categories are unrestricted
+	text := filespec(0, 0, 0, ".txt")
+	text.OriginalExtension = ".txt"
+	valid(text)
+}
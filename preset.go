@@ -0,0 +1,157 @@
+package mediaserver
+
+import (
+	"io"
+	"maps"
+	"strings"
+	"sync"
+
+	"github.com/benpate/derp"
+	"gopkg.in/yaml.v3"
+)
+
+// Preset is a named rendition (such as "avatar" or "thumbnail") that can be
+// requested instead of spelling out the dimensions and format every time.
+type Preset struct {
+	Extension string `json:"extension" yaml:"extension"` // File extension including a dot (.webp)
+	Width     int    `json:"width"     yaml:"width"`     // For images and videos, the requested width
+	Height    int    `json:"height"    yaml:"height"`    // For images and videos, the requested height
+	Bitrate   int    `json:"bitrate"   yaml:"bitrate"`   // For audio and videos, the audio bitrate
+}
+
+// FileSpec returns a FileSpec for the named file that uses the values in this Preset
+func (preset Preset) FileSpec(filename string) FileSpec {
+
+	result := NewFileSpec()
+	result.Filename = filename
+	result.Extension = preset.Extension
+	result.Width = preset.Width
+	result.Height = preset.Height
+	result.Bitrate = preset.Bitrate
+	result.Cache = true
+
+	return result
+}
+
+// Matches returns TRUE if the FileSpec requests exactly the rendition described by this Preset
+func (preset Preset) Matches(filespec FileSpec) bool {
+	return (preset.Extension == filespec.Extension) &&
+		(preset.Width == filespec.Width) &&
+		(preset.Height == filespec.Height) &&
+		(preset.Bitrate == filespec.Bitrate)
+}
+
+// presetRegistry is a thread-safe collection of named Presets
+type presetRegistry struct {
+	presets map[string]Preset
+	mutex   sync.RWMutex
+}
+
+func newPresetRegistry() *presetRegistry {
+	return &presetRegistry{
+		presets: make(map[string]Preset),
+	}
+}
+
+func (registry *presetRegistry) set(name string, preset Preset) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if (preset.Extension != "") && !strings.HasPrefix(preset.Extension, ".") {
+		preset.Extension = "." + preset.Extension
+	}
+
+	registry.presets[name] = preset
+}
+
+func (registry *presetRegistry) get(name string) (Preset, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	preset, ok := registry.presets[name]
+	return preset, ok
+}
+
+func (registry *presetRegistry) all() map[string]Preset {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	return maps.Clone(registry.presets)
+}
+
+// match returns TRUE if the FileSpec matches any registered Preset
+func (registry *presetRegistry) match(filespec FileSpec) bool {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	for _, preset := range registry.presets {
+		if preset.Matches(filespec) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithPresets registers a set of named Presets when the MediaServer is created
+func WithPresets(presets map[string]Preset) Option {
+	return func(ms *MediaServer) {
+		for name, preset := range presets {
+			ms.presets.set(name, preset)
+		}
+	}
+}
+
+// RegisterPreset adds (or replaces) a named Preset
+func (ms MediaServer) RegisterPreset(name string, preset Preset) {
+	ms.presets.set(name, preset)
+}
+
+// Preset returns the named Preset, and TRUE if it exists
+func (ms MediaServer) Preset(name string) (Preset, bool) {
+	return ms.presets.get(name)
+}
+
+// Presets returns a copy of all registered Presets
+func (ms MediaServer) Presets() map[string]Preset {
+	return ms.presets.all()
+}
+
+// PresetFileSpec returns a FileSpec for the named file using the named Preset.
+// Optional overrides are applied to the FileSpec after the Preset values.
+func (ms MediaServer) PresetFileSpec(filename string, presetName string, overrides ...func(*FileSpec)) (FileSpec, error) {
+
+	preset, ok := ms.presets.get(presetName)
+
+	if !ok {
+		return FileSpec{}, derp.NotFound("mediaserver.PresetFileSpec", "Preset not found", presetName)
+	}
+
+	result := preset.FileSpec(filename)
+
+	for _, override := range overrides {
+		override(&result)
+	}
+
+	return result, nil
+}
+
+// LoadPresets reads named Presets from a YAML (or JSON) document and registers them.
+// The document is a map of preset names to preset values, for example:
+//
+//	avatar:       {extension: .webp, width: 300, height: 300}
+//	podcast-128k: {extension: .mp3, bitrate: 128}
+func (ms MediaServer) LoadPresets(reader io.Reader) error {
+
+	presets := make(map[string]Preset)
+
+	if err := yaml.NewDecoder(reader).Decode(&presets); (err != nil) && (err != io.EOF) {
+		return derp.Wrap(err, "mediaserver.LoadPresets", "Unable to decode presets")
+	}
+
+	for name, preset := range presets {
+		ms.presets.set(name, preset)
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package mediaserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPresets(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working)
+
+	err := ms.LoadPresets(strings.NewReader(`
+avatar: {extension: webp, width: 300, height: 300}
+podcast-128k: {extension: .mp3, bitrate: 128}
+`))
+	require.Nil(t, err)
+
+	filespec, err := ms.PresetFileSpec("photo", "avatar", func(filespec *FileSpec) {
+		filespec.Extension = ".jpg"
+	})
+	require.Nil(t, err)
+	require.Equal(t, "photo", filespec.Filename)
+	require.Equal(t, ".jpg", filespec.Extension)
+	require.Equal(t, 300, filespec.Width)
+
+	preset, ok := ms.Preset("podcast-128k")
+	require.True(t, ok)
+	require.Equal(t, 128, preset.Bitrate)
+
+	_, err = ms.PresetFileSpec("photo", "missing")
+	require.NotNil(t, err)
+
+	// JSON documents work, too
+	require.Nil(t, ms.LoadPresets(strings.NewReader(`{"hero": {"extension": ".webp", "width": 1200}}`)))
+	_, ok = ms.Preset("hero")
+	require.True(t, ok)
+}
+
+func TestPresetsOnly(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working,
+		WithPresets(map[string]Preset{"plain": {Extension: ".txt"}}),
+		WithPolicy(Policy{PresetsOnly: true}),
+		WithSigner(NewSigner("key1", []byte("secret")).AllowPresets()),
+	)
+
+	require.Nil(t, ms.Put("notes", strings.NewReader("hello world")))
+	handler := NewHandler(ms)
+
+	// Unsigned requests for a preset are allowed
+	{
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notes?preset=plain", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "hello world", recorder.Body.String())
+	}
+
+	// Unsigned requests for anything else are not
+	{
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notes.txt?w=4999", nil))
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	}
+}
@@ -0,0 +1,192 @@
+package mediaserver
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// Scanner inspects uploads for viruses (or other unwanted content) before they are stored.
+type Scanner interface {
+
+	// Scan reads an entire upload and reports whether it is infected.  It returns an
+	// error if the upload could not be scanned, in which case the upload is rejected.
+	Scan(file io.Reader) (ScanResult, error)
+}
+
+// ScanResult is the verdict of a Scanner
+type ScanResult struct {
+	Infected  bool   // TRUE if the upload must not be stored
+	Signature string // Name of the signature that matched (if infected)
+}
+
+// WithScanner scans every upload while it is being written.  Infected uploads are
+// never stored (they are discarded, or quarantined, see WithQuarantine) and Put returns an
+// InfectedError.  Uploads that cannot be scanned are also rejected, so scanner outages reject
+// uploads instead of letting them through.  Normalized images are scanned as they were received
+// (before FFmpeg reads them, or they are archived) and again after normalization.
+func WithScanner(scanner Scanner) Option {
+	return func(ms *MediaServer) {
+		ms.scanner = scanner
+	}
+}
+
+// WithQuarantine moves infected uploads into a separate filesystem (under the same
+// filename) instead of discarding them, so that they can be reviewed later.
+func WithQuarantine(quarantine afero.Fs) Option {
+	return func(ms *MediaServer) {
+		ms.quarantine = quarantine
+	}
+}
+
+// scanJob scans an upload in the background, while it is being written.
+type scanJob struct {
+	writer *io.PipeWriter
+	done   chan struct{}
+	result ScanResult
+	err    error
+}
+
+// startScan begins scanning the bytes that are written to the returned scanJob
+func startScan(scanner Scanner) *scanJob {
+
+	reader, writer := io.Pipe()
+
+	job := &scanJob{
+		writer: writer,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		job.result, job.err = scanner.Scan(reader)
+
+		// Keep reading, so that uploads finish even if the scanner stopped early
+		_, _ = io.Copy(io.Discard, reader)
+		close(job.done)
+	}()
+
+	return job
+}
+
+// Write passes upload bytes to the Scanner
+func (job *scanJob) Write(buffer []byte) (int, error) {
+	return job.writer.Write(buffer)
+}
+
+// wait finishes the upload and returns the Scanner's verdict.  Uploads without a Scanner are always accepted.
+func (job *scanJob) wait() (ScanResult, error) {
+
+	if job == nil {
+		return ScanResult{}, nil
+	}
+
+	_ = job.writer.Close()
+	<-job.done
+	return job.result, job.err
+}
+
+// abort stops a scan because the upload failed
+func (job *scanJob) abort(err error) {
+
+	if job == nil {
+		return
+	}
+
+	_ = job.writer.CloseWithError(err)
+	<-job.done
+}
+
+// quarantineStaged moves an infected upload out of the staging folder and into the
+// quarantine filesystem (if there is one).  Infected uploads are never stored as originals.
+func (ms MediaServer) quarantineStaged(filename string, stagingPath string) error {
+
+	const location = "mediaserver.quarantineStaged"
+
+	// Remove the staging file even if it cannot be quarantined
+	defer ms.removeStaged(ms.original, stagingPath)
+
+	if ms.quarantine == nil {
+		return nil
+	}
+
+	source, err := ms.original.Open(stagingPath)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to open infected upload", filename)
+	}
+
+	defer func() {
+		if err := source.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close infected upload", filename))
+		}
+	}()
+
+	return ms.quarantineFile(filename, source)
+}
+
+// scanLocalFile scans a file in the local temp directory, quarantining it if it is infected.
+// It returns an InfectedError if the file is infected.
+func (ms MediaServer) scanLocalFile(filename string, localPath string) error {
+
+	const location = "mediaserver.scanLocalFile"
+
+	if ms.scanner == nil {
+		return nil
+	}
+
+	file, err := os.Open(localPath)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to open temporary file", localPath)
+	}
+
+	defer func() {
+		if err := file.Close(); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to close temporary file", localPath))
+		}
+	}()
+
+	verdict, err := ms.scanner.Scan(file)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to scan upload", filename)
+	}
+
+	if !verdict.Infected {
+		return nil
+	}
+
+	if ms.quarantine != nil {
+
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to rewind infected upload", filename))
+		} else if err := ms.quarantineFile(filename, file); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to quarantine infected upload", filename))
+		}
+	}
+
+	return InfectedError{Filename: filename, Signature: verdict.Signature}
+}
+
+// quarantineFile writes an infected upload into the quarantine filesystem
+func (ms MediaServer) quarantineFile(filename string, source io.Reader) error {
+
+	const location = "mediaserver.quarantineFile"
+
+	quarantinePath := ms.scopedName(filename)
+
+	if folder := path.Dir(quarantinePath); folder != "." {
+		if err := ensureAferoFolderExists(ms.quarantine, folder); err != nil {
+			return derp.Wrap(err, location, "Unable to create folder in 'quarantine' filesystem", filename)
+		}
+	}
+
+	if err := afero.WriteReader(ms.quarantine, quarantinePath, source); err != nil {
+		return derp.Wrap(err, location, "Unable to write file in 'quarantine' filesystem", filename)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package mediaserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signer creates and verifies HMAC signatures for FileSpec URLs, so that clients
+// cannot request arbitrary sizes or formats that have not been approved by the application.
+// Signers support key rotation: new URLs are always signed with the current key,
+// but URLs signed with any known key are accepted.
+type Signer struct {
+	currentKeyID string
+	keys         map[string][]byte
+	allowPresets bool
+}
+
+// NewSigner returns a fully initialized Signer that signs new URLs with the provided key.
+func NewSigner(keyID string, secret []byte) Signer {
+
+	return Signer{
+		currentKeyID: keyID,
+		keys: map[string][]byte{
+			keyID: secret,
+		},
+	}
+}
+
+// WithKey returns a copy of the Signer that also accepts URLs signed with an additional (usually older) key.
+func (signer Signer) WithKey(keyID string, secret []byte) Signer {
+
+	keys := make(map[string][]byte, len(signer.keys)+1)
+
+	for id, value := range signer.keys {
+		keys[id] = value
+	}
+
+	keys[keyID] = secret
+	signer.keys = keys
+	return signer
+}
+
+// AllowPresets returns a copy of the Signer that lets MediaServers accept unsigned
+// requests that exactly match one of their registered Presets.
+func (signer Signer) AllowPresets() Signer {
+	signer.allowPresets = true
+	return signer
+}
+
+// Sign returns the URL query parameters for a signed FileSpec.
+// If expires is the zero time, then the signature never expires.
+func (signer Signer) Sign(filespec FileSpec, expires time.Time) url.Values {
+
+	result := filespec.query()
+
+	expiration := int64(0)
+
+	if !expires.IsZero() {
+		expiration = expires.Unix()
+		result.Set("exp", strconv.FormatInt(expiration, 10))
+	}
+
+	result.Set("kid", signer.currentKeyID)
+	result.Set("sig", signer.signature(signer.keys[signer.currentKeyID], signer.currentKeyID, filespec, expiration))
+
+	return result
+}
+
+// SignURL returns the relative URL (path and query string) for a signed FileSpec.
+// If expires is the zero time, then the signature never expires.
+func (signer Signer) SignURL(filespec FileSpec, expires time.Time) string {
+	return filespec.DownloadFilename() + "?" + signer.Sign(filespec, expires).Encode()
+}
+
+// Verify confirms that the URL query parameters contain a valid, unexpired signature for the FileSpec.
+// It returns a SignatureError if the signature is missing, unrecognized, tampered with, or expired.
+func (signer Signer) Verify(filespec FileSpec, query url.Values) error {
+
+	signature := query.Get("sig")
+
+	if signature == "" {
+		return SignatureError{Reason: "missing signature"}
+	}
+
+	keyID := query.Get("kid")
+	secret, ok := signer.keys[keyID]
+
+	if !ok {
+		return SignatureError{Reason: "unrecognized key: " + keyID}
+	}
+
+	expiration := int64(0)
+
+	if value := query.Get("exp"); value != "" {
+
+		parsed, err := strconv.ParseInt(value, 10, 64)
+
+		if err != nil {
+			return SignatureError{Reason: "invalid expiration"}
+		}
+
+		expiration = parsed
+	}
+
+	expected := signer.signature(secret, keyID, filespec, expiration)
+
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return SignatureError{Reason: "signature does not match"}
+	}
+
+	if (expiration != 0) && (time.Now().Unix() > expiration) {
+		return SignatureError{Reason: "signature has expired"}
+	}
+
+	return nil
+}
+
+// signature calculates the (base64 encoded) HMAC for a FileSpec
+func (signer Signer) signature(secret []byte, keyID string, filespec FileSpec, expiration int64) string {
+
+	message := strings.Join([]string{
+		filespec.Filename,
+		filespec.Extension,
+		strconv.Itoa(filespec.Width),
+		strconv.Itoa(filespec.Height),
+		strconv.Itoa(filespec.Bitrate),
+		filespec.Version,
+		strconv.FormatInt(expiration, 10),
+		keyID,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
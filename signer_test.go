@@ -0,0 +1,64 @@
+package mediaserver
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner(t *testing.T) {
+
+	signer := NewSigner("key1", []byte("secret1"))
+
+	filespec := NewFileSpec()
+	filespec.Filename = "photo"
+	filespec.Extension = ".webp"
+	filespec.Width = 300
+	filespec.Height = 300
+
+	query := signer.Sign(filespec, time.Time{})
+	require.Nil(t, signer.Verify(filespec, query))
+
+	// Signed URLs round-trip through ParseFileSpec
+	parsed, err := url.Parse(signer.SignURL(filespec, time.Time{}))
+	require.Nil(t, err)
+	require.Nil(t, signer.Verify(ParseFileSpec(parsed.Path, parsed.Query()), parsed.Query()))
+
+	// Tampered dimensions are rejected
+	tampered := filespec
+	tampered.Width = 4999
+	err = signer.Verify(tampered, query)
+	require.NotNil(t, err)
+	require.Equal(t, 403, derp.ErrorCode(err))
+
+	// Missing signatures are rejected
+	require.NotNil(t, signer.Verify(filespec, url.Values{}))
+}
+
+func TestSigner_Expired(t *testing.T) {
+
+	signer := NewSigner("key1", []byte("secret1"))
+	filespec := NewFileSpec()
+	filespec.Filename = "photo"
+
+	require.Nil(t, signer.Verify(filespec, signer.Sign(filespec, time.Now().Add(time.Minute))))
+	require.NotNil(t, signer.Verify(filespec, signer.Sign(filespec, time.Now().Add(-time.Minute))))
+}
+
+func TestSigner_Rotation(t *testing.T) {
+
+	filespec := NewFileSpec()
+	filespec.Filename = "photo"
+
+	oldSigner := NewSigner("key1", []byte("secret1"))
+	newSigner := NewSigner("key2", []byte("secret2")).WithKey("key1", []byte("secret1"))
+
+	// New signer accepts URLs signed with the old key
+	require.Nil(t, newSigner.Verify(filespec, oldSigner.Sign(filespec, time.Time{})))
+
+	// Old signer does not recognize the new key
+	require.NotNil(t, oldSigner.Verify(filespec, newSigner.Sign(filespec, time.Time{})))
+}
@@ -0,0 +1,671 @@
+package mediaserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/spf13/afero"
+)
+
+// TusVersion is the version of the tus resumable upload protocol that TusHandler implements
+const TusVersion = "1.0.0"
+
+// tusExtensions lists the tus protocol extensions that TusHandler supports
+const tusExtensions = "creation,expiration,termination"
+
+// tusStagingFolder is the (hidden) folder in the processed filesystem where partial uploads are stored
+const tusStagingFolder = ".uploads"
+
+// tusContentType is the required Content-Type of every PATCH request
+const tusContentType = "application/offset+octet-stream"
+
+// TusHandler is an http.Handler that accepts resumable uploads using the tus protocol
+// (https://tus.io/protocols/resumable-upload).  Partial uploads are staged in the processed
+// filesystem, and finished uploads are saved into the original filesystem with MediaServer.Upload.
+// It is designed to be mounted under a prefix, using http.StripPrefix:
+//
+//	OPTIONS /      reports the supported protocol version and extensions
+//	POST    /      creates a new upload.  The "filename" key of Upload-Metadata names the original file
+//	HEAD    /{id}  reports the current offset of an upload
+//	PATCH   /{id}  appends the request body to an upload, saving the original file when it is complete
+//	DELETE  /{id}  cancels an upload
+type TusHandler struct {
+	server      MediaServer
+	basePath    string
+	maxSize     int64
+	expiration  time.Duration
+	authorizers []Authorizer
+	putOptions  []PutOption
+	locks       *keyedMutex
+}
+
+// TusOption modifies a TusHandler
+type TusOption func(*TusHandler)
+
+// tusUpload describes a single upload, and is stored next to the upload's data in the staging folder
+type tusUpload struct {
+	ID       string    `json:"id"`
+	Filename string    `json:"filename"`
+	Length   int64     `json:"length"`
+	Metadata string    `json:"metadata"`
+	Expires  time.Time `json:"expires"`
+}
+
+// NewTusHandler returns a fully initialized TusHandler.  The basePath is the public URL
+// prefix where the handler is mounted, and is used to build the Location of each new upload.
+func NewTusHandler(server MediaServer, basePath string, options ...TusOption) TusHandler {
+
+	result := TusHandler{
+		server:      server,
+		basePath:    strings.TrimSuffix(basePath, "/") + "/",
+		maxSize:     server.uploadLimits.MaxBytes,
+		expiration:  24 * time.Hour,
+		authorizers: make([]Authorizer, 0),
+		locks:       newKeyedMutex(),
+	}
+
+	for _, option := range options {
+		option(&result)
+	}
+
+	return result
+}
+
+// WithTusAuthorizer adds an Authorizer hook to the TusHandler.  Every request is
+// authorized as an ActionWrite for the filename of the upload.
+func WithTusAuthorizer(authorizer Authorizer) TusOption {
+	return func(handler *TusHandler) {
+		handler.authorizers = append(handler.authorizers, authorizer)
+	}
+}
+
+// WithTusMaxSize rejects uploads that are larger than this number of bytes.
+// The default is the MaxBytes of the MediaServer's UploadLimits.
+func WithTusMaxSize(maxSize int64) TusOption {
+	return func(handler *TusHandler) {
+		handler.maxSize = maxSize
+	}
+}
+
+// WithTusExpiration sets how long an upload may go without receiving data before it is
+// abandoned.  Abandoned uploads are removed by RemoveExpired.  The default is 24 hours.
+func WithTusExpiration(expiration time.Duration) TusOption {
+	return func(handler *TusHandler) {
+		handler.expiration = expiration
+	}
+}
+
+// WithTusPutOptions applies PutOptions (such as WithVariants) when finished uploads are saved
+func WithTusPutOptions(options ...PutOption) TusOption {
+	return func(handler *TusHandler) {
+		handler.putOptions = append(handler.putOptions, options...)
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (handler TusHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+
+	writer := &handlerResponseWriter{ResponseWriter: responseWriter}
+	header := writer.Header()
+	header.Set("Tus-Resumable", TusVersion)
+
+	// OPTIONS requests do not require a protocol version
+	if request.Method == http.MethodOptions {
+		handler.options(writer)
+		return
+	}
+
+	if request.Header.Get("Tus-Resumable") != TusVersion {
+		header.Set("Tus-Version", TusVersion)
+		writeError(writer, derp.BadRequest("mediaserver.TusHandler.ServeHTTP", "Unsupported tus version", request.Header.Get("Tus-Resumable"), derp.WithCode(http.StatusPreconditionFailed)))
+		return
+	}
+
+	id := strings.Trim(request.URL.Path, "/")
+
+	var err error
+
+	switch {
+
+	case (id == "") && (request.Method == http.MethodPost):
+		err = handler.create(writer, request)
+
+	case (id != "") && (request.Method == http.MethodHead):
+		err = handler.head(writer, request, id)
+
+	case (id != "") && (request.Method == http.MethodPatch):
+		err = handler.patch(writer, request, id)
+
+	case (id != "") && (request.Method == http.MethodDelete):
+		err = handler.terminate(writer, request, id)
+
+	default:
+		header.Set("Allow", "OPTIONS, POST, HEAD, PATCH, DELETE")
+		err = derp.BadRequest("mediaserver.TusHandler.ServeHTTP", "Method not allowed", request.Method, derp.WithCode(http.StatusMethodNotAllowed))
+	}
+
+	if err != nil {
+		writeError(writer, err)
+	}
+}
+
+// options reports the capabilities of this server
+func (handler TusHandler) options(responseWriter http.ResponseWriter) {
+
+	header := responseWriter.Header()
+	header.Set("Tus-Version", TusVersion)
+	header.Set("Tus-Extension", tusExtensions)
+
+	if handler.maxSize > 0 {
+		header.Set("Tus-Max-Size", strconv.FormatInt(handler.maxSize, 10))
+	}
+
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+// create starts a new upload
+func (handler TusHandler) create(responseWriter http.ResponseWriter, request *http.Request) error {
+
+	const location = "mediaserver.TusHandler.create"
+
+	length, err := strconv.ParseInt(request.Header.Get("Upload-Length"), 10, 64)
+
+	if (err != nil) || (length < 0) {
+		return derp.BadRequest(location, "Upload-Length header is required", request.Header.Get("Upload-Length"))
+	}
+
+	if (handler.maxSize > 0) && (length > handler.maxSize) {
+		return derp.BadRequest(location, "Upload is too large", length, handler.maxSize, derp.WithCode(http.StatusRequestEntityTooLarge))
+	}
+
+	rawMetadata := request.Header.Get("Upload-Metadata")
+	metadata, err := parseTusMetadata(rawMetadata)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Invalid Upload-Metadata header", rawMetadata)
+	}
+
+	filename := metadata["filename"]
+
+	if err := handler.server.ValidateFilename(filename); err != nil {
+		return derp.Wrap(err, location, "Upload-Metadata must include a valid filename", filename)
+	}
+
+	if err := authorize(handler.authorizers, request, ActionWrite, filename); err != nil {
+		return derp.Wrap(err, location, "Request is not authorized", filename)
+	}
+
+	id, err := newTusID()
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to generate upload ID")
+	}
+
+	upload := tusUpload{
+		ID:       id,
+		Filename: filename,
+		Length:   length,
+		Metadata: rawMetadata,
+		Expires:  time.Now().Add(handler.expiration),
+	}
+
+	// Create an empty data file, so that the offset of the new upload is zero
+	if err := ensureAferoFolderExists(handler.server.processed, tusStagingFolder); err != nil {
+		return derp.Wrap(err, location, "Unable to create staging folder")
+	}
+
+	if err := afero.WriteFile(handler.server.processed, upload.dataPath(), nil, 0666); err != nil {
+		return derp.Wrap(err, location, "Unable to create upload", upload)
+	}
+
+	if err := handler.save(upload); err != nil {
+		return derp.Wrap(err, location, "Unable to save upload", upload)
+	}
+
+	// Empty uploads are already complete
+	if length == 0 {
+		if err := handler.finish(upload); err != nil {
+			return derp.Wrap(err, location, "Unable to save empty upload", upload)
+		}
+	}
+
+	header := responseWriter.Header()
+	header.Set("Location", handler.basePath+id)
+	header.Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	responseWriter.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// head reports the current offset of an upload
+func (handler TusHandler) head(responseWriter http.ResponseWriter, request *http.Request, id string) error {
+
+	const location = "mediaserver.TusHandler.head"
+
+	upload, err := handler.load(id)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to load upload", id)
+	}
+
+	if err := authorize(handler.authorizers, request, ActionWrite, upload.Filename); err != nil {
+		return derp.Wrap(err, location, "Request is not authorized", upload.Filename)
+	}
+
+	offset, err := handler.offset(upload)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to read upload offset", upload)
+	}
+
+	header := responseWriter.Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	header.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	header.Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+
+	if upload.Metadata != "" {
+		header.Set("Upload-Metadata", upload.Metadata)
+	}
+
+	responseWriter.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// patch appends the request body to an upload, and saves the original file when the upload is complete
+func (handler TusHandler) patch(responseWriter http.ResponseWriter, request *http.Request, id string) error {
+
+	const location = "mediaserver.TusHandler.patch"
+
+	if request.Header.Get("Content-Type") != tusContentType {
+		return derp.BadRequest(location, "Content-Type must be "+tusContentType, request.Header.Get("Content-Type"), derp.WithCode(http.StatusUnsupportedMediaType))
+	}
+
+	// Only one request may write to an upload at a time
+	upload, unlock, err := handler.acquire(id)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to load upload", id)
+	}
+
+	defer unlock()
+
+	if err := authorize(handler.authorizers, request, ActionWrite, upload.Filename); err != nil {
+		return derp.Wrap(err, location, "Request is not authorized", upload.Filename)
+	}
+
+	// The client must resume from the current offset
+	offset, err := handler.offset(upload)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to read upload offset", upload)
+	}
+
+	if request.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		return derp.BadRequest(location, "Upload-Offset does not match the current offset", request.Header.Get("Upload-Offset"), offset, derp.WithCode(http.StatusConflict))
+	}
+
+	// Append the request body (up to the declared length) to the upload.  Data that was
+	// received before an interrupted request is kept, so that the client can resume from there.
+	file, err := handler.server.processed.OpenFile(upload.dataPath(), os.O_WRONLY|os.O_APPEND, 0666)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to open upload", upload)
+	}
+
+	written, err := io.Copy(file, io.LimitReader(request.Body, upload.Length-offset))
+
+	if closeErr := file.Close(); (closeErr != nil) && (err == nil) {
+		err = closeErr
+	}
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to write upload", upload)
+	}
+
+	offset += written
+
+	// Save the original file once every byte has been received
+	if offset == upload.Length {
+
+		if err := handler.finish(upload); err != nil {
+			return derp.Wrap(err, location, "Unable to save upload", upload)
+		}
+
+	} else {
+
+		// Otherwise, keep the upload alive for another expiration period
+		upload.Expires = time.Now().Add(handler.expiration)
+
+		if err := handler.save(upload); err != nil {
+			return derp.Wrap(err, location, "Unable to save upload", upload)
+		}
+	}
+
+	header := responseWriter.Header()
+	header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	header.Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	responseWriter.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// terminate cancels an upload, removing all of its data
+func (handler TusHandler) terminate(responseWriter http.ResponseWriter, request *http.Request, id string) error {
+
+	const location = "mediaserver.TusHandler.terminate"
+
+	upload, unlock, err := handler.acquire(id)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to load upload", id)
+	}
+
+	defer unlock()
+
+	if err := authorize(handler.authorizers, request, ActionWrite, upload.Filename); err != nil {
+		return derp.Wrap(err, location, "Request is not authorized", upload.Filename)
+	}
+
+	if err := handler.remove(upload.ID); err != nil {
+		return derp.Wrap(err, location, "Unable to remove upload", upload)
+	}
+
+	responseWriter.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// RemoveExpired removes every upload that has not received data before its expiration.
+// It returns the number of uploads that were removed.
+func (handler TusHandler) RemoveExpired() (int, error) {
+
+	const location = "mediaserver.TusHandler.RemoveExpired"
+
+	entries, err := afero.ReadDir(handler.server.processed, tusStagingFolder)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, derp.Wrap(err, location, "Unable to read staging folder")
+	}
+
+	now := time.Now()
+	removed := 0
+
+	for _, entry := range entries {
+
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+
+		if !ok {
+			continue
+		}
+
+		upload, err := handler.read(id)
+
+		// Uploads with missing or corrupt info files are removed once they are old enough
+		if err != nil {
+			upload.ID = id
+			upload.Expires = entry.ModTime().Add(handler.expiration)
+		}
+
+		if upload.Expires.After(now) {
+			continue
+		}
+
+		// Skip uploads that are being written right now
+		unlock, ok := handler.locks.tryLock(id)
+
+		if !ok {
+			continue
+		}
+
+		if err := handler.remove(id); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to remove expired upload", id))
+		} else {
+			removed++
+		}
+
+		unlock()
+	}
+
+	return removed, nil
+}
+
+// StartCleanup runs RemoveExpired in the background on the provided interval, until the context is cancelled.
+func (handler TusHandler) StartCleanup(ctx context.Context, interval time.Duration) {
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+				if _, err := handler.RemoveExpired(); err != nil {
+					derp.Report(derp.Wrap(err, "mediaserver.TusHandler.StartCleanup", "Unable to remove expired uploads"))
+				}
+			}
+		}
+	}()
+}
+
+// finish saves a completed upload into the original filesystem, then removes it from the staging folder
+func (handler TusHandler) finish(upload tusUpload) error {
+
+	const location = "mediaserver.TusHandler.finish"
+
+	file, err := handler.server.processed.Open(upload.dataPath())
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to open upload", upload)
+	}
+
+	_, err = handler.server.Upload(upload.Filename, file, handler.putOptions...)
+
+	if closeErr := file.Close(); closeErr != nil {
+		derp.Report(derp.Wrap(closeErr, location, "Unable to close upload", upload))
+	}
+
+	// The upload cannot be resumed once every byte has been received, so remove it either way
+	if removeErr := handler.remove(upload.ID); removeErr != nil {
+		derp.Report(derp.Wrap(removeErr, location, "Unable to remove finished upload", upload))
+	}
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to save original file", upload)
+	}
+
+	return nil
+}
+
+// load returns an upload that has not expired
+func (handler TusHandler) load(id string) (tusUpload, error) {
+
+	const location = "mediaserver.TusHandler.load"
+
+	upload, err := handler.read(id)
+
+	if err != nil {
+		return upload, derp.Wrap(err, location, "Upload not found", id)
+	}
+
+	if upload.Expires.Before(time.Now()) {
+		return upload, derp.NotFound(location, "Upload has expired", id, derp.WithCode(http.StatusGone))
+	}
+
+	return upload, nil
+}
+
+// read loads the info file of an upload from the staging folder
+func (handler TusHandler) read(id string) (tusUpload, error) {
+
+	const location = "mediaserver.TusHandler.read"
+
+	if !isValidTusID(id) {
+		return tusUpload{}, derp.NotFound(location, "Invalid upload ID", id)
+	}
+
+	data, err := afero.ReadFile(handler.server.processed, tusUpload{ID: id}.infoPath())
+
+	if err != nil {
+		return tusUpload{}, derp.Wrap(err, location, "Unable to read upload", id)
+	}
+
+	result := tusUpload{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return tusUpload{}, derp.Wrap(err, location, "Unable to parse upload", id)
+	}
+
+	return result, nil
+}
+
+// save writes the info file of an upload into the staging folder
+func (handler TusHandler) save(upload tusUpload) error {
+
+	data, err := json.Marshal(upload)
+
+	if err != nil {
+		return derp.Wrap(err, "mediaserver.TusHandler.save", "Unable to encode upload", upload)
+	}
+
+	if err := afero.WriteFile(handler.server.processed, upload.infoPath(), data, 0666); err != nil {
+		return derp.Wrap(err, "mediaserver.TusHandler.save", "Unable to write upload", upload)
+	}
+
+	return nil
+}
+
+// remove deletes the data and info files of an upload
+func (handler TusHandler) remove(id string) error {
+
+	upload := tusUpload{ID: id}
+
+	for _, filename := range []string{upload.dataPath(), upload.infoPath()} {
+		if err := handler.server.processed.Remove(filename); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+			return derp.Wrap(err, "mediaserver.TusHandler.remove", "Unable to remove upload", filename)
+		}
+	}
+
+	return nil
+}
+
+// offset returns the number of bytes that have been received for an upload
+func (handler TusHandler) offset(upload tusUpload) (int64, error) {
+
+	info, err := handler.server.processed.Stat(upload.dataPath())
+
+	if err != nil {
+		return 0, derp.Wrap(err, "mediaserver.TusHandler.offset", "Unable to stat upload", upload)
+	}
+
+	return info.Size(), nil
+}
+
+// acquire loads an upload and locks it, so that only one request can use it at a time.
+// Unknown (or expired) uploads are rejected before any lock is created.
+func (handler TusHandler) acquire(id string) (tusUpload, func(), error) {
+
+	const location = "mediaserver.TusHandler.acquire"
+
+	if _, err := handler.load(id); err != nil {
+		return tusUpload{}, nil, derp.Wrap(err, location, "Unable to load upload", id)
+	}
+
+	unlock, ok := handler.locks.tryLock(id)
+
+	if !ok {
+		return tusUpload{}, nil, derp.BadRequest(location, "Upload is already in progress", id, derp.WithCode(http.StatusLocked))
+	}
+
+	// Load the upload again, because another request may have finished it before the lock was acquired
+	upload, err := handler.load(id)
+
+	if err != nil {
+		unlock()
+		return tusUpload{}, nil, derp.Wrap(err, location, "Unable to load upload", id)
+	}
+
+	return upload, unlock, nil
+}
+
+// dataPath returns the location of an upload's data in the processed filesystem
+func (upload tusUpload) dataPath() string {
+	return path.Join(tusStagingFolder, upload.ID)
+}
+
+// infoPath returns the location of an upload's info file in the processed filesystem
+func (upload tusUpload) infoPath() string {
+	return path.Join(tusStagingFolder, upload.ID+".json")
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, which is a comma-separated list
+// of keys and (optional) base64-encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+
+	result := make(map[string]string)
+
+	if strings.TrimSpace(header) == "" {
+		return result, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+
+		if key == "" {
+			return nil, derp.BadRequest("mediaserver.parseTusMetadata", "Metadata key is required", pair)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+
+		if err != nil {
+			return nil, derp.Wrap(err, "mediaserver.parseTusMetadata", "Metadata value must be base64 encoded", key, derp.WithBadRequest())
+		}
+
+		result[key] = string(decoded)
+	}
+
+	return result, nil
+}
+
+// newTusID returns a new, random upload ID
+func newTusID() (string, error) {
+
+	buffer := make([]byte, 16)
+
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buffer), nil
+}
+
+// isValidTusID returns TRUE if the ID could have been created by newTusID
+func isValidTusID(id string) bool {
+
+	if len(id) != 32 {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
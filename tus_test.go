@@ -0,0 +1,175 @@
+package mediaserver
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTusHandler(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	original := afero.NewMemMapFs()
+	ms := New(original, afero.NewMemMapFs(), &working)
+	handler := http.StripPrefix("/uploads", NewTusHandler(ms, "/uploads/"))
+
+	send := func(method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Tus-Resumable", TusVersion)
+		for index := 0; index < len(headers); index += 2 {
+			request.Header.Set(headers[index], headers[index+1])
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// Report server capabilities
+	response := send(http.MethodOptions, "/uploads/", "")
+	require.Equal(t, http.StatusNoContent, response.Code)
+	require.Equal(t, TusVersion, response.Header().Get("Tus-Version"))
+	require.Contains(t, response.Header().Get("Tus-Extension"), "creation")
+
+	// Reject requests without a supported protocol version
+	{
+		request := httptest.NewRequest(http.MethodPost, "/uploads/", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	}
+
+	// Create a new upload
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("videos/notes"))
+	response = send(http.MethodPost, "/uploads/", "", "Upload-Length", "11", "Upload-Metadata", metadata)
+	require.Equal(t, http.StatusCreated, response.Code)
+
+	location := response.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, "/uploads/"))
+
+	// Send the first chunk
+	response = send(http.MethodPatch, location, "hello", "Content-Type", tusContentType, "Upload-Offset", "0")
+	require.Equal(t, http.StatusNoContent, response.Code)
+	require.Equal(t, "5", response.Header().Get("Upload-Offset"))
+
+	// Resume from the current offset
+	response = send(http.MethodHead, location, "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, "5", response.Header().Get("Upload-Offset"))
+	require.Equal(t, "11", response.Header().Get("Upload-Length"))
+
+	response = send(http.MethodPatch, location, " world", "Content-Type", tusContentType, "Upload-Offset", "0")
+	require.Equal(t, http.StatusConflict, response.Code)
+
+	response = send(http.MethodPatch, location, " world", "Content-Type", "text/plain", "Upload-Offset", "5")
+	require.Equal(t, http.StatusUnsupportedMediaType, response.Code)
+
+	response = send(http.MethodPatch, location, " world", "Content-Type", tusContentType, "Upload-Offset", "5")
+	require.Equal(t, http.StatusNoContent, response.Code)
+	require.Equal(t, "11", response.Header().Get("Upload-Offset"))
+
+	// Finished uploads are saved into the original filesystem, and removed from staging
+	content, err := afero.ReadFile(original, "videos/notes")
+	require.Nil(t, err)
+	require.Equal(t, "hello world", string(content))
+
+	response = send(http.MethodHead, location, "")
+	require.Equal(t, http.StatusNotFound, response.Code)
+
+	// Invalid filenames are rejected
+	response = send(http.MethodPost, "/uploads/", "", "Upload-Length", "11", "Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("../escape")))
+	require.Equal(t, http.StatusBadRequest, response.Code)
+
+	// Uploads can be cancelled
+	response = send(http.MethodPost, "/uploads/", "", "Upload-Length", "11", "Upload-Metadata", metadata)
+	require.Equal(t, http.StatusCreated, response.Code)
+
+	location = response.Header().Get("Location")
+	require.Equal(t, http.StatusNoContent, send(http.MethodDelete, location, "").Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodHead, location, "").Code)
+}
+
+func TestTusHandler_Expiration(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	processed := afero.NewMemMapFs()
+	ms := New(afero.NewMemMapFs(), processed, &working)
+	tus := NewTusHandler(ms, "/uploads", WithTusExpiration(-1*time.Minute))
+	handler := http.StripPrefix("/uploads", tus)
+
+	request := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	request.Header.Set("Tus-Resumable", TusVersion)
+	request.Header.Set("Upload-Length", "11")
+	request.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("notes")))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+
+	// Expired uploads cannot be resumed
+	request = httptest.NewRequest(http.MethodHead, recorder.Header().Get("Location"), nil)
+	request.Header.Set("Tus-Resumable", TusVersion)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusGone, recorder.Code)
+
+	// ...and are removed from the staging folder
+	removed, err := tus.RemoveExpired()
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+
+	entries, err := afero.ReadDir(processed, tusStagingFolder)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
+
+func TestTusHandler_Locks(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 100)
+	defer working.Close()
+
+	ms := New(afero.NewMemMapFs(), afero.NewMemMapFs(), &working)
+	tus := NewTusHandler(ms, "/uploads")
+	handler := http.StripPrefix("/uploads", tus)
+
+	// Requests for unknown uploads never create locks
+	for _, method := range []string{http.MethodPatch, http.MethodDelete, http.MethodHead} {
+
+		request := httptest.NewRequest(method, "/uploads/"+strings.Repeat("a", 32), strings.NewReader("hello"))
+		request.Header.Set("Tus-Resumable", TusVersion)
+		request.Header.Set("Content-Type", tusContentType)
+		request.Header.Set("Upload-Offset", "0")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+
+	require.Empty(t, tus.locks.locks)
+
+	// Locks are released (and removed) once each request is done
+	request := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	request.Header.Set("Tus-Resumable", TusVersion)
+	request.Header.Set("Upload-Length", "11")
+	request.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("notes")))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodPatch, recorder.Header().Get("Location"), strings.NewReader("hello"))
+	request.Header.Set("Tus-Resumable", TusVersion)
+	request.Header.Set("Content-Type", tusContentType)
+	request.Header.Set("Upload-Offset", "0")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+
+	require.Empty(t, tus.locks.locks)
+}
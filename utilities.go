@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/benpate/derp"
@@ -104,7 +105,26 @@ func writeTempFile(original io.Reader, extension string) (string, error) {
 	return tempFile.Name(), nil
 }
 
-// ensureAferoFolderExists creates a folder in the afero Filesystem if it does not already exist
+// limitReader fails with an error once more than the remaining number of bytes have been read
+type limitReader struct {
+	reader    io.Reader
+	remaining int64
+	err       error
+}
+
+func (reader *limitReader) Read(buffer []byte) (int, error) {
+
+	length, err := reader.reader.Read(buffer)
+	reader.remaining -= int64(length)
+
+	if reader.remaining < 0 {
+		return length, reader.err
+	}
+
+	return length, err
+}
+
+// ensureAferoFolderExists creates a folder (and any missing parents) in the afero Filesystem if it does not already exist
 func ensureAferoFolderExists(fs afero.Fs, path string) error {
 
 	const location = "mediaserver.ensureAferoFolderExists"
@@ -117,7 +137,7 @@ func ensureAferoFolderExists(fs afero.Fs, path string) error {
 	}
 
 	// Otherwise, create the folder in Afero
-	if err := fs.Mkdir(path, 0777); err != nil {
+	if err := fs.MkdirAll(path, 0777); err != nil {
 		return derp.Wrap(err, location, "Unable to create directory for cached file", path)
 	}
 
@@ -161,3 +181,93 @@ func first[T comparable](values ...T) T {
 
 	return zero
 }
+
+// countingWriter counts the number of bytes written through it
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	length, err := w.writer.Write(data)
+	w.count += int64(length)
+	return length, err
+}
+
+// keyedMutex provides a separate lock for each key, removing unused locks as it goes
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		locks: make(map[string]*keyedLock),
+	}
+}
+
+// lock blocks until the key is available, then returns a function that unlocks it
+func (keyed *keyedMutex) lock(key string) func() {
+
+	keyed.mutex.Lock()
+	lock, ok := keyed.locks[key]
+
+	if !ok {
+		lock = &keyedLock{}
+		keyed.locks[key] = lock
+	}
+
+	lock.users++
+	keyed.mutex.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		keyed.release(key, lock)
+	}
+}
+
+// tryLock locks the key if it is available, returning FALSE (without waiting) if it is not
+func (keyed *keyedMutex) tryLock(key string) (func(), bool) {
+
+	keyed.mutex.Lock()
+	defer keyed.mutex.Unlock()
+
+	lock, ok := keyed.locks[key]
+
+	if !ok {
+		lock = &keyedLock{}
+		keyed.locks[key] = lock
+	}
+
+	// New locks are always available, so failures never leave an unused lock behind
+	if !lock.TryLock() {
+		return nil, false
+	}
+
+	lock.users++
+
+	return func() {
+		keyed.release(key, lock)
+	}, true
+}
+
+// release unlocks a key, removing its lock once nobody is using or waiting for it
+func (keyed *keyedMutex) release(key string, lock *keyedLock) {
+
+	lock.Unlock()
+
+	keyed.mutex.Lock()
+	defer keyed.mutex.Unlock()
+
+	lock.users--
+
+	if lock.users == 0 {
+		delete(keyed.locks, key)
+	}
+}
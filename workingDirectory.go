@@ -1,9 +1,19 @@
 package mediaserver
 
 import (
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/benpate/derp"
@@ -12,29 +22,111 @@ import (
 
 // WorkingDirectory manages files added and removed to the working directory.
 type WorkingDirectory struct {
-	folder string
-	cache  otter.Cache[string, int64]
-	ttl    time.Duration
-	done   chan struct{}
+	folder      string
+	cache       otter.Cache[string, workingEntry]
+	ttl         time.Duration
+	minFreeDisk int64
+	maxFileSize int64 // Largest file that fits in the byte budget (zero means unlimited)
+	temporary   bool  // TRUE if the folder was created for this WorkingDirectory, and is removed by Close
+	done        chan struct{}
 }
 
-// NewWorkingDirectory returns a fully initialized WorkingDirectory object
-func NewWorkingDirectory(folder string, ttl time.Duration, capacity int) WorkingDirectory {
+// workingEntry tracks a single file in the working directory
+type workingEntry struct {
+	expires int64 // Unix time when the file expires
+	size    int64 // Size of the file, in bytes
+	owned   bool  // TRUE if the file was written by this WorkingDirectory (and not left over from a previous process)
+}
+
+// WorkingDirectoryOption modifies a WorkingDirectory
+type WorkingDirectoryOption func(*workingDirectoryConfig)
+
+type workingDirectoryConfig struct {
+	cleanStart  bool
+	maxBytes    int64
+	minFreeDisk int64
+}
+
+// WithCleanStart removes every file left in the working directory (from a previous process)
+// on startup, instead of re-registering them.
+func WithCleanStart() WorkingDirectoryOption {
+	return func(config *workingDirectoryConfig) {
+		config.cleanStart = true
+	}
+}
+
+// WithMaxBytes limits the total size of all files in the working directory, replacing the
+// file-count capacity.  Each file is weighted by its size, so large files are evicted to
+// make room for many small ones.  Files larger than a tenth of the budget are not
+// kept in the working directory, and are served directly from the processed filesystem.
+func WithMaxBytes(maxBytes int64) WorkingDirectoryOption {
+	return func(config *workingDirectoryConfig) {
+		config.maxBytes = maxBytes
+	}
+}
+
+// WithMinFreeDisk keeps at least this many bytes free on the working directory's disk.
+// Before each write, the files closest to expiring are removed until enough space is free.
+// If that is not possible, the write fails with a 507 (Insufficient Storage) error.
+// This has no effect on systems where free disk space cannot be measured.
+func WithMinFreeDisk(minFreeDisk int64) WorkingDirectoryOption {
+	return func(config *workingDirectoryConfig) {
+		config.minFreeDisk = minFreeDisk
+	}
+}
+
+// NewWorkingDirectory returns a fully initialized WorkingDirectory object.
+// Files left over from a previous process (in the WorkingDirectory's shard layout) are
+// re-registered (and expire based on their modification time) or removed on startup.
+// Other files in the folder are never touched.  If the folder is empty (or is the shared
+// system temp directory) then a new folder is created inside the system temp directory
+// for this WorkingDirectory alone, and is removed by Close.
+func NewWorkingDirectory(folder string, ttl time.Duration, capacity int, options ...WorkingDirectoryOption) WorkingDirectory {
 
 	const location = "mediaserver.NewWorkingDirectory"
 
-	if folder == "" {
-		folder = os.TempDir()
+	config := workingDirectoryConfig{}
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	// Never manage the shared temp directory directly, because other programs (and
+	// other processes using this package) use it too.
+	temporary := false
+
+	if (folder == "") || (filepath.Clean(folder) == filepath.Clean(os.TempDir())) {
+
+		if tempFolder, err := os.MkdirTemp("", "mediaserver-working-"); err == nil {
+			folder = tempFolder
+			temporary = true
+		} else {
+			derp.Report(derp.Wrap(err, location, "Unable to create temporary working directory"))
+		}
+	}
+
+	if err := os.MkdirAll(folder, 0777); err != nil {
+		derp.Report(derp.Wrap(err, location, "Unable to create working directory", folder))
 	}
 
 	result := WorkingDirectory{
-		folder: folder,
-		ttl:    ttl,
-		done:   make(chan struct{}),
+		folder:      folder,
+		temporary:   temporary,
+		ttl:         ttl,
+		minFreeDisk: config.minFreeDisk,
+		done:        make(chan struct{}),
+	}
+
+	// Byte budgets are counted in kilobytes, so that large budgets fit in the cache's capacity
+	if config.maxBytes > 0 {
+		capacity = int(min(kilobytes(config.maxBytes), math.MaxInt32))
+
+		// The cache rejects any single file that costs more than a tenth of its capacity
+		result.maxFileSize = int64(capacity/10) * 1024
 	}
 
 	// Create a cache builder
-	builder, err := otter.NewBuilder[string, int64](capacity)
+	builder, err := otter.NewBuilder[string, workingEntry](capacity)
 
 	if err != nil {
 		panic(err)
@@ -42,6 +134,13 @@ func NewWorkingDirectory(folder string, ttl time.Duration, capacity int) Working
 
 	// Configure the cache builder
 	builder.DeletionListener(result.onDelete)
+
+	if config.maxBytes > 0 {
+		builder.Cost(func(_ string, entry workingEntry) uint32 {
+			return uint32(min(max(kilobytes(entry.size), 1), math.MaxUint32))
+		})
+	}
+
 	builder.WithTTL(ttl)
 
 	// Build the cache
@@ -51,26 +150,58 @@ func NewWorkingDirectory(folder string, ttl time.Duration, capacity int) Working
 		derp.Report(derp.Wrap(err, location, "Unable to build Otter cache"))
 	}
 
-	// Add the cache into the result and return
+	// Add the cache into the result
 	result.cache = cache
 
+	// Rebuild state from files left over by a previous process
+	if err := result.scan(config.cleanStart); err != nil {
+		derp.Report(derp.Wrap(err, location, "Unable to scan working directory", folder))
+	}
+
 	go result.start()
 	return result
 }
 
 // Exists returns TRUE if the file exists in the working directory
 func (wd *WorkingDirectory) Exists(name string) bool {
+
+	if validateWorkingName(name) != nil {
+		return false
+	}
+
 	_, err := os.Stat(wd.filename(name))
 	return err == nil
 }
 
-// Write adds a new file into the working directory, and sets a TTL for the file to be deleted
+// Fits returns TRUE if a file of this size can be kept in the working directory.
+// Larger files are rejected by Write, so callers should serve them some other way.
+func (wd *WorkingDirectory) Fits(size int64) bool {
+	return (wd.maxFileSize == 0) || (size <= wd.maxFileSize)
+}
+
+// Write adds a new file into the working directory, and sets a TTL for the file to be deleted.
+// Files that are too large for the byte budget fail with a 507 (Insufficient Storage) error
+// as soon as the budget is exceeded, without writing the rest of the file.
 func (wd *WorkingDirectory) Write(name string, reader io.Reader) error {
 
 	const location = "mediaserver.WorkingDirector.Write"
 
+	if err := validateWorkingName(name); err != nil {
+		return derp.Wrap(err, location, "Invalid file name", name)
+	}
+
 	filename := wd.filename(name)
 
+	// Make room on the disk before writing anything
+	if err := wd.ensureFreeDisk(); err != nil {
+		return derp.Wrap(err, location, "Unable to free disk space", filename)
+	}
+
+	// Create the shard directory for this file
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return derp.Wrap(err, location, "Unable to create directory", filename)
+	}
+
 	// Open the file
 	writer, err := os.Create(filename)
 
@@ -78,8 +209,18 @@ func (wd *WorkingDirectory) Write(name string, reader io.Reader) error {
 		return derp.Wrap(err, location, "Unable to create file", filename)
 	}
 
-	// Copy the data into the file
-	if _, err := io.Copy(writer, reader); err != nil {
+	// Copy the data into the file, stopping as soon as it is too large to keep
+	if wd.maxFileSize > 0 {
+		reader = &limitReader{
+			reader:    reader,
+			remaining: wd.maxFileSize,
+			err:       derp.Internal(location, "File is too large for the working directory", filename, wd.maxFileSize, derp.WithCode(http.StatusInsufficientStorage)),
+		}
+	}
+
+	size, err := io.Copy(writer, reader)
+
+	if err != nil {
 
 		if errClose := writer.Close(); errClose != nil {
 			return derp.Wrap(err, location, "Unable to copy data into file", filename, errClose)
@@ -96,8 +237,16 @@ func (wd *WorkingDirectory) Write(name string, reader io.Reader) error {
 		return derp.Wrap(err, location, "Unable to close file writer")
 	}
 
-	// Add the file to the cache
-	wd.cache.Set(name, time.Now().Add(wd.ttl).Unix())
+	// Add the file to the cache.  Files that are too large for the budget are rejected.
+	if !wd.cache.Set(name, workingEntry{expires: time.Now().Add(wd.ttl).Unix(), size: size, owned: true}) {
+
+		if err := os.Remove(filename); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to remove rejected file", filename))
+		}
+
+		return derp.Internal(location, "File is too large for the working directory", filename, size, derp.WithCode(http.StatusInsufficientStorage))
+	}
+
 	return nil
 }
 
@@ -107,6 +256,10 @@ func (wd *WorkingDirectory) Open(name string) (*os.File, error) {
 
 	const location = "mediaserver.WorkingDirectory.Open"
 
+	if err := validateWorkingName(name); err != nil {
+		return nil, derp.Wrap(err, location, "Invalid file name", name)
+	}
+
 	// Try to open the file.
 	file, err := os.Open(wd.filename(name))
 
@@ -114,8 +267,17 @@ func (wd *WorkingDirectory) Open(name string) (*os.File, error) {
 		return nil, derp.Wrap(err, location, "Error opening file", name)
 	}
 
-	// Reset the TTL
-	wd.cache.Set(name, time.Now().Add(wd.ttl).Unix())
+	// Reset the TTL, keeping the known file size
+	entry, ok := wd.cache.Get(name)
+
+	if !ok {
+		if info, err := file.Stat(); err == nil {
+			entry.size = info.Size()
+		}
+	}
+
+	entry.expires = time.Now().Add(wd.ttl).Unix()
+	wd.cache.Set(name, entry)
 
 	// Return the file to the caller
 	return file, nil
@@ -124,7 +286,15 @@ func (wd *WorkingDirectory) Open(name string) (*os.File, error) {
 // Remove deletes a file from the working directory
 // This should trigger the onDelete event for the file.
 func (wd *WorkingDirectory) Remove(name string) {
-	wd.cache.Delete(filepath.Join(wd.folder, name))
+	wd.cache.Delete(name)
+}
+
+// RemoveFunc deletes every file from the working directory whose name matches the predicate.
+// This should trigger the onDelete event for each file.
+func (wd *WorkingDirectory) RemoveFunc(predicate func(name string) bool) {
+	wd.cache.DeleteByFunc(func(name string, _ workingEntry) bool {
+		return predicate(name)
+	})
 }
 
 // RemoveAll deletes all files from the working directory
@@ -133,11 +303,110 @@ func (wd *WorkingDirectory) RemoveAll() {
 	wd.cache.Clear()
 }
 
-// Close shuts down the working directory, all background processes, and deletes all files from the filesystem
+// Close shuts down the working directory and all background processes, and deletes the files
+// that this WorkingDirectory wrote.  Files left over from a previous process are not removed,
+// so that processes sharing a folder do not delete each other's files.
 func (wd *WorkingDirectory) Close() {
+
+	const location = "mediaserver.WorkingDirectory.Close"
+
 	close(wd.done)
-	wd.RemoveAll()
+
+	wd.cache.Range(func(name string, entry workingEntry) bool {
+
+		if entry.owned {
+			if err := os.Remove(wd.filename(name)); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+				derp.Report(derp.Wrap(err, location, "Unable to remove file", name))
+			}
+		}
+
+		return true
+	})
+
 	wd.cache.Close()
+
+	// Temporary folders belong to this WorkingDirectory alone
+	if wd.temporary {
+		if err := os.RemoveAll(wd.folder); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to remove temporary working directory", wd.folder))
+		}
+	}
+}
+
+// scan registers every file already in the working directory, so that it can be expired
+// and removed normally.  Each file expires one TTL after it was last modified.
+// Expired files (or all files, if clean is TRUE) are removed immediately.  Only files
+// in the shard layout (see filename) are considered, so other files are never removed.
+func (wd *WorkingDirectory) scan(clean bool) error {
+
+	const location = "mediaserver.WorkingDirectory.scan"
+
+	now := time.Now()
+
+	return filepath.WalkDir(wd.folder, func(path string, entry fs.DirEntry, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(wd.folder, path)
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to find relative path", path)
+		}
+
+		if relative == "." {
+			return nil
+		}
+
+		depth := len(strings.Split(relative, string(filepath.Separator)))
+
+		// Only descend into shard folders (two levels of two hex digits)
+		if entry.IsDir() {
+			if (depth > 2) || !isShardName(entry.Name()) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// Ignore files outside of the shard folders
+		if depth != 3 {
+			return nil
+		}
+
+		info, err := entry.Info()
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to read file info", path)
+		}
+
+		// Recover the name from the file, and ignore files that are not stored where they belong
+		name, err := url.PathUnescape(entry.Name())
+
+		if (err != nil) || (validateWorkingName(name) != nil) || (wd.filename(name) != path) {
+			return nil
+		}
+
+		expiration := info.ModTime().Add(wd.ttl)
+
+		// Remove expired files right away
+		if clean || expiration.Before(now) {
+			if err := os.Remove(path); err != nil {
+				derp.Report(derp.Wrap(err, location, "Unable to remove file", path))
+			}
+			return nil
+		}
+
+		// Otherwise, track the file like any other.  Files that are too large for the budget
+		// are rejected by the cache, and would never be removed, so remove them now.
+		if !wd.cache.Set(name, workingEntry{expires: expiration.Unix(), size: info.Size()}) {
+			if err := os.Remove(path); err != nil {
+				derp.Report(derp.Wrap(err, location, "Unable to remove rejected file", path))
+			}
+		}
+
+		return nil
+	})
 }
 
 // Start runs a background process to actively remove files from the working directory that have expired
@@ -155,8 +424,8 @@ func (wd *WorkingDirectory) start() {
 
 			now := time.Now().Unix()
 
-			wd.cache.DeleteByFunc(func(filename string, expiration int64) bool {
-				return (expiration < now)
+			wd.cache.DeleteByFunc(func(filename string, entry workingEntry) bool {
+				return (entry.expires < now)
 			})
 		}
 	}
@@ -164,20 +433,124 @@ func (wd *WorkingDirectory) start() {
 
 // onDelete is called when the file is evicted from the cache, and
 // is responsible for deleting the working file from the filesystem
-func (wd *WorkingDirectory) onDelete(key string, value int64, cause otter.DeletionCause) {
+func (wd *WorkingDirectory) onDelete(key string, value workingEntry, cause otter.DeletionCause) {
 
 	// RULE: Ignore "Replaced"  events. The value is still there :)
 	if cause == otter.Replaced {
 		return
 	}
 
-	// Delete the file from the filesystem
-	if err := os.Remove(wd.filename(key)); err != nil {
+	// Delete the file from the filesystem (unless it was already removed to free disk space)
+	if err := os.Remove(wd.filename(key)); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
 		derp.Report(derp.Wrap(err, "mediaserver.WorkingDirectory.onDelete", "Unable to delete file", key, cause))
 	}
 }
 
-// filename (correctly) appends the provided name to the working directory folder
+// ensureFreeDisk removes the files closest to expiring until the disk has at least
+// minFreeDisk bytes available.  Files are removed right away (instead of waiting for
+// the cache to evict them) so that the space is available for the next write.
+func (wd *WorkingDirectory) ensureFreeDisk() error {
+
+	const location = "mediaserver.WorkingDirectory.ensureFreeDisk"
+
+	if wd.minFreeDisk <= 0 {
+		return nil
+	}
+
+	available, ok := freeDiskSpace(wd.folder)
+
+	if !ok || (available >= wd.minFreeDisk) {
+		return nil
+	}
+
+	// Collect every file, sorted so that the files closest to expiring are removed first
+	type candidate struct {
+		name  string
+		entry workingEntry
+	}
+
+	candidates := make([]candidate, 0, wd.cache.Size())
+
+	wd.cache.Range(func(name string, entry workingEntry) bool {
+		candidates = append(candidates, candidate{name: name, entry: entry})
+		return true
+	})
+
+	slices.SortFunc(candidates, func(a candidate, b candidate) int {
+		return cmp.Compare(a.entry.expires, b.entry.expires)
+	})
+
+	for _, candidate := range candidates {
+
+		if err := os.Remove(wd.filename(candidate.name)); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+			derp.Report(derp.Wrap(err, location, "Unable to remove file", candidate.name))
+			continue
+		}
+
+		wd.cache.Delete(candidate.name)
+
+		if available, ok = freeDiskSpace(wd.folder); ok && (available >= wd.minFreeDisk) {
+			return nil
+		}
+	}
+
+	return derp.Internal(location, "Not enough free disk space in working directory", wd.folder, available, wd.minFreeDisk, derp.WithCode(http.StatusInsufficientStorage))
+}
+
+// isShardName returns TRUE if the name is a shard folder, made of two lowercase hex digits
+func isShardName(name string) bool {
+
+	if len(name) != 2 {
+		return false
+	}
+
+	for _, character := range name {
+		if !strings.ContainsRune("0123456789abcdef", character) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// kilobytes converts a number of bytes into kilobytes, rounding up
+func kilobytes(bytes int64) int64 {
+	return (bytes + 1023) / 1024
+}
+
+// filename returns the location of a (valid) name within the working directory folder.
+// Files are sharded into two levels of subdirectories using a hash of the name, so that
+// no single directory grows too large.  The name itself is escaped into a single path
+// segment, so it can never point outside of its shard directory.
 func (wd *WorkingDirectory) filename(name string) string {
-	return filepath.Join(wd.folder, name)
+
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	shard := fmt.Sprintf("%08x", hash.Sum32())
+
+	return filepath.Join(wd.folder, shard[0:2], shard[2:4], url.PathEscape(name))
+}
+
+// validateWorkingName returns an error if the name is not safe to use in the working directory.
+// Names are slash-separated relative paths (like "folder/file_w300.jpg") whose segments are
+// not empty, ".", or "..", and which do not contain backslashes or NUL characters.
+func validateWorkingName(name string) error {
+
+	const location = "mediaserver.validateWorkingName"
+
+	if name == "" {
+		return derp.BadRequest(location, "Name must not be empty")
+	}
+
+	if strings.ContainsAny(name, "\\\x00") {
+		return derp.BadRequest(location, "Name must not contain backslashes or NUL characters", name)
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if (segment == "") || (segment == ".") || (segment == "..") {
+			return derp.BadRequest(location, "Name must be a relative path without empty, '.', or '..' segments", name)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,178 @@
+package mediaserver
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkingDirectory_Scan(t *testing.T) {
+
+	folder := t.TempDir()
+	layout := WorkingDirectory{folder: folder}
+	fresh := layout.filename("fresh.txt")
+	expired := layout.filename("expired.txt")
+	unrecognized := filepath.Join(folder, "unrecognized.txt")
+	misplaced := filepath.Join(filepath.Dir(fresh), "misplaced.txt")
+
+	require.Nil(t, os.MkdirAll(filepath.Dir(fresh), 0777))
+	require.Nil(t, os.MkdirAll(filepath.Dir(expired), 0777))
+	require.Nil(t, os.WriteFile(unrecognized, []byte("unrecognized"), 0666))
+	require.Nil(t, os.WriteFile(misplaced, []byte("misplaced"), 0666))
+	require.Nil(t, os.WriteFile(fresh, []byte("fresh"), 0666))
+	require.Nil(t, os.WriteFile(expired, []byte("expired"), 0666))
+
+	old := time.Now().Add(-1 * time.Hour)
+	require.Nil(t, os.Chtimes(expired, old, old))
+
+	working := NewWorkingDirectory(folder, 1*time.Minute, 100)
+
+	// Expired files are removed, and fresh files are tracked again
+	require.False(t, working.Exists("expired.txt"))
+	require.NoFileExists(t, expired)
+	require.True(t, working.Exists("fresh.txt"))
+	require.True(t, working.cache.Has("fresh.txt"))
+
+	// Files that are not in the shard layout are never removed
+	require.FileExists(t, unrecognized)
+	require.FileExists(t, misplaced)
+
+	// Close only removes the files that this WorkingDirectory wrote
+	require.Nil(t, working.Write("written.txt", strings.NewReader("written")))
+	working.Close()
+
+	require.NoFileExists(t, layout.filename("written.txt"))
+	require.FileExists(t, fresh)
+}
+
+func TestWorkingDirectory_Temporary(t *testing.T) {
+
+	// Working directories without a folder do not share one with other processes
+	first := NewWorkingDirectory("", 1*time.Minute, 100)
+	second := NewWorkingDirectory("", 1*time.Minute, 100)
+	require.NotEqual(t, first.folder, second.folder)
+
+	require.Nil(t, first.Write("notes.txt", strings.NewReader("notes")))
+	require.Nil(t, second.Write("notes.txt", strings.NewReader("notes")))
+
+	first.Close()
+	require.NoDirExists(t, first.folder)
+	require.True(t, second.Exists("notes.txt"))
+
+	second.Close()
+	require.NoDirExists(t, second.folder)
+}
+
+func TestWorkingDirectory_CleanStart(t *testing.T) {
+
+	// Leave a file from a previous process
+	layout := WorkingDirectory{folder: t.TempDir()}
+	fresh := layout.filename("fresh.txt")
+	require.Nil(t, os.MkdirAll(filepath.Dir(fresh), 0777))
+	require.Nil(t, os.WriteFile(fresh, []byte("fresh"), 0666))
+
+	working := NewWorkingDirectory(layout.folder, 1*time.Minute, 100, WithCleanStart())
+	defer working.Close()
+
+	require.False(t, working.Exists("fresh.txt"))
+}
+
+func TestWorkingDirectory_MaxBytes(t *testing.T) {
+
+	working := NewWorkingDirectory(t.TempDir(), 1*time.Minute, 0, WithMaxBytes(40*1024))
+	defer working.Close()
+
+	// Files larger than a tenth of the budget are rejected
+	require.True(t, working.Fits(4*1024))
+	require.False(t, working.Fits(4*1024+1))
+
+	err := working.Write("huge.txt", bytes.NewReader(make([]byte, 8*1024)))
+	require.Equal(t, http.StatusInsufficientStorage, derp.ErrorCode(err))
+	require.False(t, working.Exists("huge.txt"))
+
+	// Files that fit in the budget evict older files to make room
+	for index := range 20 {
+		require.Nil(t, working.Write(fmt.Sprint(index, ".txt"), bytes.NewReader(make([]byte, 3*1024))))
+	}
+
+	require.Eventually(t, func() bool {
+		count := 0
+		for index := range 20 {
+			if working.Exists(fmt.Sprint(index, ".txt")) {
+				count++
+			}
+		}
+		return (count > 0) && (count*3 <= 40)
+	}, time.Second, 10*time.Millisecond)
+
+	// Files left over from a previous process that are too large are removed on startup
+	huge := working.filename("huge.txt")
+	require.Nil(t, os.MkdirAll(filepath.Dir(huge), 0777))
+	require.Nil(t, os.WriteFile(huge, make([]byte, 8*1024), 0666))
+
+	restarted := NewWorkingDirectory(working.folder, 1*time.Minute, 0, WithMaxBytes(40*1024))
+	defer restarted.Close()
+	require.NoFileExists(t, huge)
+}
+
+func TestWorkingDirectory_MinFreeDisk(t *testing.T) {
+
+	if _, ok := freeDiskSpace(t.TempDir()); !ok {
+		t.Skip("free disk space cannot be measured on this platform")
+	}
+
+	// Leave a file from a previous process
+	layout := WorkingDirectory{folder: t.TempDir()}
+	existing := layout.filename("existing.txt")
+	require.Nil(t, os.MkdirAll(filepath.Dir(existing), 0777))
+	require.Nil(t, os.WriteFile(existing, []byte("existing"), 0666))
+
+	// No disk can satisfy this guard, so existing files are removed and the write is refused
+	working := NewWorkingDirectory(layout.folder, 1*time.Minute, 100, WithMinFreeDisk(math.MaxInt64))
+	defer working.Close()
+
+	require.True(t, working.Exists("existing.txt"))
+
+	err := working.Write("new.txt", strings.NewReader("new"))
+	require.Equal(t, http.StatusInsufficientStorage, derp.ErrorCode(err))
+	require.False(t, working.Exists("existing.txt"))
+	require.False(t, working.Exists("new.txt"))
+}
+
+func TestWorkingDirectory_Layout(t *testing.T) {
+
+	folder := t.TempDir()
+	working := NewWorkingDirectory(folder, 1*time.Minute, 100)
+	defer working.Close()
+
+	// Nested names are stored in a single, sharded file
+	require.Nil(t, working.Write("folder/file_w300.txt", strings.NewReader("content")))
+	require.True(t, working.Exists("folder/file_w300.txt"))
+
+	filename := working.filename("folder/file_w300.txt")
+	relative, err := filepath.Rel(folder, filename)
+	require.Nil(t, err)
+	require.Len(t, strings.Split(filepath.ToSlash(relative), "/"), 3)
+
+	// Names that could escape the working directory are rejected
+	for _, name := range []string{"", "../escape.txt", "folder/../../escape.txt", "/absolute.txt", "folder//file.txt", "./file.txt", "back\\slash.txt"} {
+		require.NotNil(t, working.Write(name, strings.NewReader("escape")), name)
+		require.False(t, working.Exists(name), name)
+	}
+
+	// Remove uses the same name as Write
+	working.Remove("folder/file_w300.txt")
+
+	require.Eventually(t, func() bool {
+		return !working.Exists("folder/file_w300.txt")
+	}, time.Second, 10*time.Millisecond)
+}